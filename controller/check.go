@@ -0,0 +1,110 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+
+	"k8s.io/klog/v2"
+)
+
+// checkTuple the data of the events queued to cni CHECK a network
+// attachment, checks go through the event queue so that they don't
+// run concurrently with an add or a delete of the same attachment
+type checkTuple struct {
+	cni.AttachmentTuple
+	// Check distinguishes the key of a check event from the one of
+	// the attachment's add/delete events (see Event.getKey)
+	Check bool
+}
+
+// checkNetworks queue a check event for every network attachment
+// expected to be added whose running config is in state
+func (c *Controller) checkNetworks(state RunningState) {
+	cfgRecords, err := c.configStore.listConfigRecords()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list config records")
+		return
+	}
+	for _, cfgRecord := range cfgRecords {
+		if cfgRecord.Expected.Optype != Add || cfgRecord.Running.State != state {
+			continue
+		}
+		cniParams, err := getCNIParams(cfgRecord.Running.Data)
+		if err != nil || cniParams.PodName == "" {
+			continue
+		}
+		ct := &checkTuple{
+			AttachmentTuple: *c.getCNIAttachmentTuple(cniParams.Namespace, cniParams.PodName, getAttachmentName(cniParams.NetworkNamespace, cniParams.NetworkName)),
+			Check:           true,
+		}
+		c.eventQueue.Enqueue(&Event{data: ct})
+	}
+}
+
+// processCheck cni CHECK a network attachment:
+//   - an Active one that fails the check is marked Dirty and get re-plugged
+//   - a Dirty one (i.e. an add interrupted by a crash) that passes the check
+//     is marked Active, otherwise it get re-plugged
+func (c *Controller) processCheck(ctx context.Context, ct *checkTuple) {
+	ctx = withOpLogger(ctx, "Check")
+	logger := klog.FromContext(ctx)
+	key := c.configStore.getConfigRecordKey(ct.Namespace, ct.PodName, ct.NetworkName)
+	cfgRecord, err := c.configStore.getConfigRecord(key)
+	if err != nil {
+		logger.V(3).Info("Network config record not found, ignoring check")
+		return
+	}
+	if cfgRecord.Expected.Optype != Add || (cfgRecord.Running.State != Active && cfgRecord.Running.State != Dirty) {
+		return
+	}
+	cniParams, err := getCNIParams(cfgRecord.Running.Data)
+	if err != nil {
+		logger.Error(err, "Failed decoding running config")
+		return
+	}
+
+	err = c.cniPlugin.CheckNetwork(ctx, cniParams)
+	switch {
+	case errors.Is(err, cni.ErrCheckNotSupported):
+		logger.V(4).Info("Skipping check", "reason", err)
+		if cfgRecord.Running.State == Dirty {
+			c.eventQueue.Enqueue(&Event{data: &ct.AttachmentTuple})
+		}
+	case err != nil:
+		logger.Error(err, "Check of network failed, re-plugging it", "sandbox", cniParams.SandboxID)
+		if cfgRecord.Running.State == Active {
+			cfgRecord.Running.State = Dirty
+			if err := c.configStore.saveRunningConfig(key, cfgRecord.Running); err != nil {
+				logger.Error(err, "Failed saving running config")
+				return
+			}
+		}
+		c.eventQueue.Enqueue(&Event{data: &ct.AttachmentTuple})
+	case cfgRecord.Running.State == Dirty:
+		logger.V(3).Info("Check of network passed, marking it active")
+		cfgRecord.Running.State = Active
+		if err := c.configStore.saveRunningConfig(key, cfgRecord.Running); err != nil {
+			logger.Error(err, "Failed saving running config")
+		}
+	default:
+		logger.V(5).Info("Check of network passed")
+	}
+}
@@ -19,17 +19,22 @@ package cni
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	kc "github.com/kaloom/kubernetes-common"
 
 	"github.com/containernetworking/cni/libcni"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
-	"github.com/golang/glog"
+	"github.com/containernetworking/cni/pkg/version"
+	"k8s.io/klog/v2"
 	utilexec "k8s.io/utils/exec"
 )
 
@@ -40,41 +45,125 @@ const (
 	DefaultCNIDir = "/opt/cni/bin"
 )
 
+// NetworkKind the kind of the network resource a network attachment refers to
+type NetworkKind string
+
+const (
+	// KaloomNetwork a kaloom.com/v1 Network resource, handled by kactus
+	KaloomNetwork NetworkKind = ""
+	// NetworkAttachmentDefinition a k8s.cni.cncf.io/v1 NetworkAttachmentDefinition resource
+	NetworkAttachmentDefinition NetworkKind = "NetworkAttachmentDefinition"
+)
+
 // Parameters the params struct for the cni-plugin
 type Parameters struct {
 	Namespace   string
 	PodName     string
+	PodUID      string
+	ContainerID string
 	SandboxID   string
 	NetnsPath   string
 	NetworkName string
-	IfMAC       string
+	// NetworkNamespace the namespace of the network resource, empty if
+	// it's the Pod's namespace
+	NetworkNamespace string
+	NetworkKind      NetworkKind
+	// NetworkConfig if set, the cni config (or config list) of the network
+	// that get invoked directly instead of the default network
+	NetworkConfig []byte
+	// NetworkGeneration the generation of the network resource when
+	// the network attachment got added, 0 if unknown
+	NetworkGeneration int64
+	// IfName the network device name, if empty it's derived off the network name
+	IfName string
+	IfMAC  string
+	// IPs, Bandwidth and PortMappings along with IfMAC are passed to the
+	// plugins supporting the respective runtime config capabilities
+	IPs          []string
+	Bandwidth    *BandwidthEntry
+	PortMappings []PortMapEntry
+	// Args the extra cni args, appended to the K8S_POD_* ones
+	Args map[string]string
+}
+
+// BandwidthEntry the "bandwidth" capability's runtime config
+type BandwidthEntry struct {
+	IngressRate  int `json:"ingressRate"`
+	IngressBurst int `json:"ingressBurst"`
+	EgressRate   int `json:"egressRate"`
+	EgressBurst  int `json:"egressBurst"`
+}
+
+// PortMapEntry an element of the "portMappings" capability's runtime config
+type PortMapEntry struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
 }
 
+// ErrCheckNotSupported is returned by CheckNetwork when the network's
+// cni version doesn't support the CHECK command
+var ErrCheckNotSupported = errors.New("cni CHECK not supported by the network's cni version")
+
 // AttachmentTuple the attachment tuple for the cni-plugin
 type AttachmentTuple struct {
+	Namespace   string
 	PodName     string
 	NetworkName string
 }
 
+// Interface the cni operations on the network attachments, NetworkPlugin
+// implements it by invoking the cni-plugins (see the fake package for test
+// implementations)
+type Interface interface {
+	// AddNetwork add a network attachment off cniParams
+	AddNetwork(ctx context.Context, cniParams *Parameters) error
+	// DeleteNetwork delete a network attachment off cniParams
+	DeleteNetwork(ctx context.Context, cniParams *Parameters) error
+	// CheckNetwork check a network attachment off cniParams,
+	// ErrCheckNotSupported is returned if the network can't be checked
+	CheckNetwork(ctx context.Context, cniParams *Parameters) error
+	// ReleaseLeakedNetworks delete the network attachments of the
+	// sandboxes that don't exist anymore
+	ReleaseLeakedNetworks(ctx context.Context, sandboxExists func(sandboxID string) bool, minAge time.Duration)
+	// SyncNetworkConfig (re)loads the default network
+	SyncNetworkConfig()
+	// Ready returns an error if the network attachments can't be handled
+	Ready() error
+}
+
+var _ Interface = &NetworkPlugin{}
+
 // NetworkPlugin object to export
 type NetworkPlugin struct {
 	sync.RWMutex
 	defaultNetwork *cniNetwork
+	// validationErr the error of the default network's validation
+	validationErr error
 
 	execer      utilexec.Interface
 	nsenterPath string
 	pluginDir   string
 	binDir      string
 	vendorName  string
+	// timeout the timeout of a cni-plugin invocation, 0 for none
+	timeout time.Duration
+	// exec runs the cni-plugins, through nsenter in the host's namespaces
+	// if the plugin was created with useNsenter
+	exec *pluginExec
 }
 
 type cniNetwork struct {
 	name          string
 	NetworkConfig *libcni.NetworkConfigList
 	CNIConfig     libcni.CNI
+	// path the directories where the network's plugins are looked up
+	path []string
+	exec *pluginExec
 }
 
-func getDefaultCNINetwork(pluginDir, binDir, vendorName string) (*cniNetwork, error) {
+func getDefaultCNINetwork(pluginDir, binDir, vendorName string, exec *pluginExec) (*cniNetwork, error) {
 	if pluginDir == "" {
 		pluginDir = DefaultNetDir
 	}
@@ -92,43 +181,78 @@ func getDefaultCNINetwork(pluginDir, binDir, vendorName string) (*cniNetwork, er
 		if strings.HasSuffix(confFile, ".conflist") {
 			confList, err = libcni.ConfListFromFile(confFile)
 			if err != nil {
-				glog.Warningf("Error loading CNI config list file %s: %v", confFile, err)
+				klog.ErrorS(err, "Failed to load cni config list file", "file", confFile)
 				continue
 			}
 		} else {
 			conf, err := libcni.ConfFromFile(confFile)
 			if err != nil {
-				glog.Warningf("Error loading CNI config file %s: %v", confFile, err)
+				klog.ErrorS(err, "Failed to load cni config file", "file", confFile)
 				continue
 			}
 			// Ensure the config has a "type" so we know what plugin to run.
 			// Also catches the case where somebody put a conflist into a conf file.
 			if conf.Network.Type == "" {
-				glog.Warningf("Error loading CNI config file %s: no 'type'; perhaps this is a .conflist?", confFile)
+				klog.InfoS("Skipping cni config file with no 'type', perhaps it's a .conflist", "file", confFile)
 				continue
 			}
 
 			confList, err = libcni.ConfListFromConf(conf)
 			if err != nil {
-				glog.Warningf("Error converting CNI config file %s to list: %v", confFile, err)
+				klog.ErrorS(err, "Failed to convert cni config file to a list", "file", confFile)
 				continue
 			}
 		}
 		if len(confList.Plugins) == 0 {
-			glog.Warningf("CNI config list %s has no networks, skipping", confFile)
+			klog.InfoS("Skipping cni config list with no networks", "file", confFile)
 			continue
 		}
-		confType := confList.Plugins[0].Network.Type
+		return newCNINetwork(confList, binDir, vendorName, exec), nil
+	}
+	return nil, fmt.Errorf("No valid networks found in %s", pluginDir)
+}
+
+func newCNINetwork(confList *libcni.NetworkConfigList, binDir, vendorName string, exec *pluginExec) *cniNetwork {
+	confType := confList.Plugins[0].Network.Type
+
+	// Search for vendor-specific plugins as well as default plugins in the CNI codebase.
+	vendorDir := vendorCNIDir(vendorName, confType)
+	path := []string{vendorDir, binDir}
+	cninet := libcni.NewCNIConfigWithCacheDir(path, exec.hostPath(libcni.CacheDir), exec)
+	return &cniNetwork{name: confList.Name, NetworkConfig: confList, CNIConfig: cninet, path: path, exec: exec}
+}
 
-		// Search for vendor-specific plugins as well as default plugins in the CNI codebase.
-		vendorDir := vendorCNIDir(vendorName, confType)
-		cninet := &libcni.CNIConfig{
-			Path: []string{vendorDir, binDir},
+// getCNINetworkFromBytes returns a cni network off a cni config or a cni
+// config list (i.e. having a "plugins" list)
+func getCNINetworkFromBytes(config []byte, binDir, vendorName string, exec *pluginExec) (*cniNetwork, error) {
+	var confList *libcni.NetworkConfigList
+	rawList := make(map[string]interface{})
+	if err := json.Unmarshal(config, &rawList); err != nil {
+		return nil, fmt.Errorf("error parsing network config: %v", err)
+	}
+	if _, ok := rawList["plugins"]; ok {
+		var err error
+		confList, err = libcni.ConfListFromBytes(config)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		conf, err := libcni.ConfFromBytes(config)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Network.Type == "" {
+			return nil, fmt.Errorf("error parsing network config: no 'type'")
+		}
+		confList, err = libcni.ConfListFromConf(conf)
+		if err != nil {
+			return nil, err
 		}
-		network := &cniNetwork{name: confList.Name, NetworkConfig: confList, CNIConfig: cninet}
-		return network, nil
 	}
-	return nil, fmt.Errorf("No valid networks found in %s", pluginDir)
+	if len(confList.Plugins) == 0 {
+		return nil, fmt.Errorf("network config list %s has no plugins", confList.Name)
+	}
+	return newCNINetwork(confList, binDir, vendorName, exec), nil
 }
 
 func vendorCNIDir(vendorName, pluginType string) string {
@@ -138,31 +262,64 @@ func vendorCNIDir(vendorName, pluginType string) string {
 	return fmt.Sprintf("/opt/%s/bin", pluginType)
 }
 
-// NewCNIPlugin instantiate a cni plugin object
-func NewCNIPlugin(cniBinPath, cniConfPath, cniVendorName string) (*NetworkPlugin, error) {
+// NewCNIPlugin instantiate a cni plugin object, a cni-plugin invocation
+// taking longer than timeout (if not 0) get killed. If useNsenter is set,
+// the cni-plugins are run through nsenter in the mount and network
+// namespaces of the host, cniBinPath and libcni's cache are then host paths
+func NewCNIPlugin(cniBinPath, cniConfPath, cniVendorName string, timeout time.Duration, useNsenter bool) (*NetworkPlugin, error) {
 	var err error
 	plugin := &NetworkPlugin{
 		binDir:     cniBinPath,
 		pluginDir:  cniConfPath,
 		vendorName: cniVendorName,
+		timeout:    timeout,
 		execer:     utilexec.New(),
 	}
 	plugin.nsenterPath, err = plugin.execer.LookPath("nsenter")
 	if err != nil {
 		return nil, err
 	}
+	plugin.exec = &pluginExec{}
+	if useNsenter {
+		plugin.exec.nsenterPath = plugin.nsenterPath
+		klog.InfoS("Running the cni-plugins in the host's namespaces", "nsenter", plugin.nsenterPath)
+	}
 
-	plugin.syncNetworkConfig()
+	plugin.SyncNetworkConfig()
 	return plugin, nil
 }
 
-func (plugin *NetworkPlugin) syncNetworkConfig() {
-	network, err := getDefaultCNINetwork(plugin.pluginDir, plugin.binDir, plugin.vendorName)
+// SyncNetworkConfig (re)loads the default network off the first lexical cni
+// config and validates its plugins (see Ready)
+func (plugin *NetworkPlugin) SyncNetworkConfig() {
+	network, err := getDefaultCNINetwork(plugin.pluginDir, plugin.binDir, plugin.vendorName, plugin.exec)
 	if err != nil {
-		glog.Warningf("Unable to update cni config: %s", err)
+		klog.ErrorS(err, "Unable to update the cni config")
 		return
 	}
-	plugin.setDefaultNetwork(network)
+	ctx, cancel := plugin.withTimeout(context.Background())
+	defer cancel()
+	err = network.validate(ctx)
+	if err != nil {
+		klog.ErrorS(err, "Invalid cni network", "cniNetwork", network.name)
+	} else {
+		klog.V(3).InfoS("Validated cni network", "cniNetwork", network.name, "path", network.path)
+	}
+	plugin.Lock()
+	defer plugin.Unlock()
+	plugin.defaultNetwork = network
+	plugin.validationErr = err
+}
+
+// Ready returns an error if the default network isn't loaded or its
+// validation failed
+func (plugin *NetworkPlugin) Ready() error {
+	if err := plugin.checkInitialized(); err != nil {
+		return err
+	}
+	plugin.RLock()
+	defer plugin.RUnlock()
+	return plugin.validationErr
 }
 
 func (plugin *NetworkPlugin) getDefaultNetwork() *cniNetwork {
@@ -171,12 +328,6 @@ func (plugin *NetworkPlugin) getDefaultNetwork() *cniNetwork {
 	return plugin.defaultNetwork
 }
 
-func (plugin *NetworkPlugin) setDefaultNetwork(n *cniNetwork) {
-	plugin.Lock()
-	defer plugin.Unlock()
-	plugin.defaultNetwork = n
-}
-
 func (plugin *NetworkPlugin) checkInitialized() error {
 	if plugin.getDefaultNetwork() == nil {
 		return errors.New("cni config uninitialized")
@@ -184,70 +335,247 @@ func (plugin *NetworkPlugin) checkInitialized() error {
 	return nil
 }
 
-// AddNetwork add a network attachment off cniParams
-func (plugin *NetworkPlugin) AddNetwork(cniParams *Parameters) error {
-	if err := plugin.checkInitialized(); err != nil {
+// getNetwork returns the cni network to invoke for cniParams, it's the
+// default network unless cniParams carries its own network config
+func (plugin *NetworkPlugin) getNetwork(cniParams *Parameters) (*cniNetwork, error) {
+	if len(cniParams.NetworkConfig) == 0 {
+		if err := plugin.checkInitialized(); err != nil {
+			return nil, err
+		}
+		return plugin.getDefaultNetwork(), nil
+	}
+	network, err := getCNINetworkFromBytes(cniParams.NetworkConfig, plugin.binDir, plugin.vendorName, plugin.exec)
+	if err != nil {
+		return nil, &cnitypes.Error{Code: cnitypes.ErrInvalidNetworkConfig, Msg: "invalid network config", Details: err.Error()}
+	}
+	return network, nil
+}
+
+// withTimeout returns a context derived off ctx that expires after the
+// plugin's timeout
+func (plugin *NetworkPlugin) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if plugin.timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, plugin.timeout)
+}
+
+// CheckNetwork check a network attachment off cniParams against the
+// result cached by libcni when the network attachment got added,
+// ErrCheckNotSupported is returned for networks prior to cni 0.4.0
+func (plugin *NetworkPlugin) CheckNetwork(ctx context.Context, cniParams *Parameters) error {
+	network, err := plugin.getNetwork(cniParams)
+	if err != nil {
 		return err
 	}
-	_, err := plugin.addToNetwork(plugin.getDefaultNetwork(), cniParams)
+	ctx, cancel := plugin.withTimeout(ctx)
+	defer cancel()
+	ctx, wrapErr := withPluginOutput(ctx)
+	err = plugin.checkNetwork(ctx, network, cniParams)
+	if errors.Is(err, ErrCheckNotSupported) {
+		return err
+	}
+	return wrapErr(err)
+}
+
+// AddNetwork add a network attachment off cniParams, the cni-plugins get
+// killed if ctx is done before they complete
+func (plugin *NetworkPlugin) AddNetwork(ctx context.Context, cniParams *Parameters) error {
+	network, err := plugin.getNetwork(cniParams)
 	if err != nil {
-		glog.Errorf("Error while adding to cni network: %s", err)
+		return err
+	}
+	ctx, cancel := plugin.withTimeout(ctx)
+	defer cancel()
+	ctx, wrapErr := withPluginOutput(ctx)
+	_, err = plugin.addToNetwork(ctx, network, cniParams)
+	if err != nil {
+		err = wrapErr(err)
+		klog.FromContext(ctx).Error(err, "Failed to add to the cni network")
 		return err
 	}
 
 	return err
 }
 
-// DeleteNetwork delete a network attachment off cniParams
-func (plugin *NetworkPlugin) DeleteNetwork(cniParams *Parameters) error {
-	if err := plugin.checkInitialized(); err != nil {
+// DeleteNetwork delete a network attachment off cniParams, the cni-plugins
+// get killed if ctx is done before they complete
+func (plugin *NetworkPlugin) DeleteNetwork(ctx context.Context, cniParams *Parameters) error {
+	network, err := plugin.getNetwork(cniParams)
+	if err != nil {
 		return err
 	}
-	return plugin.deleteFromNetwork(plugin.getDefaultNetwork(), cniParams)
+	ctx, cancel := plugin.withTimeout(ctx)
+	defer cancel()
+	ctx, wrapErr := withPluginOutput(ctx)
+	return wrapErr(plugin.deleteFromNetwork(ctx, network, cniParams))
 }
 
-func (plugin *NetworkPlugin) addToNetwork(network *cniNetwork, cniParams *Parameters) (cnitypes.Result, error) {
+func (plugin *NetworkPlugin) addToNetwork(ctx context.Context, network *cniNetwork, cniParams *Parameters) (cnitypes.Result, error) {
 	rt, err := plugin.buildCNIRuntimeConf(cniParams)
 	if err != nil {
-		glog.Errorf("Error adding network when building cni runtime conf: %v", err)
+		klog.FromContext(ctx).Error(err, "Failed to build the cni runtime conf")
 		return nil, err
 	}
 
 	netConf, cniNet := network.NetworkConfig, network.CNIConfig
-	glog.V(4).Infof("About to add CNI network %v (type=%v)", cniParams.NetworkName, netConf.Plugins[0].Network.Type)
-	res, err := cniNet.AddNetworkList(context.Background(), netConf, rt)
+	klog.FromContext(ctx).V(4).Info("Adding cni network", "type", netConf.Plugins[0].Network.Type)
+	res, err := cniNet.AddNetworkList(ctx, netConf, rt)
 	if err != nil {
-		glog.Errorf("Error adding network: %v", err)
 		return nil, err
 	}
 
 	return res, nil
 }
 
-func (plugin *NetworkPlugin) deleteFromNetwork(network *cniNetwork, cniParams *Parameters) error {
+func (plugin *NetworkPlugin) deleteFromNetwork(ctx context.Context, network *cniNetwork, cniParams *Parameters) error {
 	rt, err := plugin.buildCNIRuntimeConf(cniParams)
 	if err != nil {
-		glog.Errorf("Error deleting network when building cni runtime conf: %v", err)
+		klog.FromContext(ctx).Error(err, "Failed to build the cni runtime conf")
 		return err
 	}
 
+	// the netns is gone when the Pod's sandbox has been torn down, the
+	// plugins are still invoked for them to release their resources (e.g. ipam)
+	if rt.NetNS != "" {
+		if _, err := os.Stat(plugin.exec.hostPath(rt.NetNS)); os.IsNotExist(err) {
+			rt.NetNS = ""
+		}
+	}
+
+	netConf, cniNet := network.NetworkConfig, network.CNIConfig
+	klog.FromContext(ctx).V(4).Info("Deleting cni network", "type", netConf.Plugins[0].Network.Type)
+	err = cniNet.DelNetworkList(ctx, netConf, rt)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to delete the cni network")
+		return err
+	}
+	return nil
+}
+
+// cachedInfo the subset of a libcni's cache entry used by podagent
+type cachedInfo struct {
+	ContainerID    string                 `json:"containerId"`
+	Config         []byte                 `json:"config"`
+	IfName         string                 `json:"ifName"`
+	NetworkName    string                 `json:"networkName"`
+	CniArgs        [][2]string            `json:"cniArgs,omitempty"`
+	CapabilityArgs map[string]interface{} `json:"capabilityArgs,omitempty"`
+}
+
+// ReleaseLeakedNetworks best-effort cni DEL the network attachments found
+// in libcni's cache that have been added by podagent (i.e. having the
+// K8S_POD_NETWORK cni arg) and whose sandbox doesn't exist anymore, their
+// cache entries are removed once released, or if their config can't be
+// parsed, the ones failing to be released are retried on the next call.
+// Entries younger than minAge are skipped, their
+// sandbox might not be known yet to the caller
+func (plugin *NetworkPlugin) ReleaseLeakedNetworks(ctx context.Context, sandboxExists func(sandboxID string) bool, minAge time.Duration) {
+	dir := filepath.Join(plugin.exec.hostPath(libcni.CacheDir), "results")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.ErrorS(err, "Failed to read the cni cache directory", "dir", dir)
+		}
+		return
+	}
+
+	for _, f := range files {
+		if ctx.Err() != nil {
+			return
+		}
+		path := filepath.Join(dir, f.Name())
+		info, err := f.Info()
+		if err != nil || info.IsDir() || time.Since(info.ModTime()) < minAge {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		cached := cachedInfo{}
+		if err := json.Unmarshal(data, &cached); err != nil {
+			klog.V(4).InfoS("Ignoring cni cache entry", "path", path, "err", err)
+			continue
+		}
+		if !isPodagentNetwork(cached.CniArgs) || sandboxExists(cached.ContainerID) {
+			continue
+		}
+
+		klog.InfoS("Releasing leaked network", "network", cached.NetworkName, "ifName", cached.IfName, "sandbox", cached.ContainerID)
+		network, err := getCNINetworkFromBytes(cached.Config, plugin.binDir, plugin.vendorName, plugin.exec)
+		if err != nil {
+			// the entry can't ever be released, it's dropped
+			klog.ErrorS(err, "Failed to parse the config of leaked network, dropping it", "network", cached.NetworkName, "sandbox", cached.ContainerID)
+		} else {
+			rt := &libcni.RuntimeConf{
+				ContainerID:    cached.ContainerID,
+				IfName:         cached.IfName,
+				Args:           cached.CniArgs,
+				CapabilityArgs: cached.CapabilityArgs,
+			}
+			delCtx, cancel := plugin.withTimeout(ctx)
+			err = network.CNIConfig.DelNetworkList(delCtx, network.NetworkConfig, rt)
+			cancel()
+			if err != nil {
+				// libcni keeps the entry on a failed DEL, it's the only
+				// record of the leaked network, retried on the next run
+				klog.ErrorS(err, "Failed to release leaked network", "network", cached.NetworkName, "sandbox", cached.ContainerID)
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			klog.ErrorS(err, "Failed to remove cni cache entry", "path", path)
+		}
+	}
+}
+
+func isPodagentNetwork(args [][2]string) bool {
+	for _, arg := range args {
+		if arg[0] == "K8S_POD_NETWORK" {
+			return true
+		}
+	}
+	return false
+}
+
+func (plugin *NetworkPlugin) checkNetwork(ctx context.Context, network *cniNetwork, cniParams *Parameters) error {
 	netConf, cniNet := network.NetworkConfig, network.CNIConfig
-	glog.V(4).Infof("About to del CNI network %v (type=%v)", cniParams.NetworkName, netConf.Plugins[0].Network.Type)
-	err = cniNet.DelNetworkList(context.Background(), netConf, rt)
+	// CHECK was added in CNI spec version 0.4.0
+	if gtet, err := version.GreaterThanOrEqualTo(netConf.CNIVersion, "0.4.0"); err != nil {
+		return err
+	} else if !gtet {
+		return ErrCheckNotSupported
+	}
+
+	rt, err := plugin.buildCNIRuntimeConf(cniParams)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to build the cni runtime conf")
+		return err
+	}
+
+	klog.FromContext(ctx).V(4).Info("Checking cni network", "type", netConf.Plugins[0].Network.Type)
+	err = cniNet.CheckNetworkList(ctx, netConf, rt)
 	if err != nil {
-		glog.Errorf("Error deleting network: %v", err)
 		return err
 	}
 	return nil
 }
 
 func (plugin *NetworkPlugin) buildCNIRuntimeConf(cniParams *Parameters) (*libcni.RuntimeConf, error) {
-	glog.V(4).Infof("Pod's %s cni parameters: netns path %s in namespace %s", cniParams.PodName, cniParams.NetnsPath, cniParams.Namespace)
+	klog.V(4).InfoS("Pod's cni parameters", "pod", klog.KRef(cniParams.Namespace, cniParams.PodName), "network", cniParams.NetworkName, "sandbox", cniParams.SandboxID, "netns", cniParams.NetnsPath)
 
+	ifName := cniParams.IfName
+	if ifName == "" {
+		ifName = kc.GetNetworkIfname(cniParams.NetworkName)
+	}
 	rt := &libcni.RuntimeConf{
 		ContainerID: cniParams.SandboxID,
 		NetNS:       cniParams.NetnsPath,
-		IfName:      kc.GetNetworkIfname(cniParams.NetworkName),
+		IfName:      ifName,
 		Args: [][2]string{
 			{"IgnoreUnknown", "1"},
 			{"K8S_POD_NAMESPACE", cniParams.Namespace},
@@ -256,7 +584,39 @@ func (plugin *NetworkPlugin) buildCNIRuntimeConf(cniParams *Parameters) (*libcni
 			{"K8S_POD_NETWORK", cniParams.NetworkName},
 			{"K8S_POD_IFMAC", cniParams.IfMAC},
 		},
+		CapabilityArgs: getCapabilityArgs(cniParams),
+	}
+	// sorted so that the cni-plugins get the same CNI_ARGS on every invocation
+	keys := make([]string, 0, len(cniParams.Args))
+	for k := range cniParams.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rt.Args = append(rt.Args, [2]string{k, cniParams.Args[k]})
 	}
 
 	return rt, nil
 }
+
+// getCapabilityArgs returns the runtime config capabilities off cniParams,
+// libcni passes them only to the plugins declaring the capability
+func getCapabilityArgs(cniParams *Parameters) map[string]interface{} {
+	capabilityArgs := make(map[string]interface{})
+	if len(cniParams.IPs) > 0 {
+		capabilityArgs["ips"] = cniParams.IPs
+	}
+	if cniParams.IfMAC != "" {
+		capabilityArgs["mac"] = cniParams.IfMAC
+	}
+	if cniParams.Bandwidth != nil {
+		capabilityArgs["bandwidth"] = cniParams.Bandwidth
+	}
+	if len(cniParams.PortMappings) > 0 {
+		capabilityArgs["portMappings"] = cniParams.PortMappings
+	}
+	if len(capabilityArgs) == 0 {
+		return nil
+	}
+	return capabilityArgs
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildCNIRuntimeConfArgs(t *testing.T) {
+	cniParams := &Parameters{
+		Namespace:   "default",
+		PodName:     "vnf",
+		SandboxID:   "s1",
+		NetnsPath:   "/var/run/netns/s1",
+		NetworkName: "green",
+		IfMAC:       "02:00:00:00:00:01",
+		Args:        map[string]string{"VLAN": "100", "MTU": "9000", "Bridge": "br0"},
+	}
+	want := [][2]string{
+		{"IgnoreUnknown", "1"},
+		{"K8S_POD_NAMESPACE", "default"},
+		{"K8S_POD_NAME", "vnf"},
+		{"K8S_POD_INFRA_CONTAINER_ID", "s1"},
+		{"K8S_POD_NETWORK", "green"},
+		{"K8S_POD_IFMAC", "02:00:00:00:00:01"},
+		// the extra args follow, sorted
+		{"Bridge", "br0"},
+		{"MTU", "9000"},
+		{"VLAN", "100"},
+	}
+	plugin := &NetworkPlugin{}
+	// the extra args are sorted on every invocation
+	for i := 0; i < 10; i++ {
+		rt, err := plugin.buildCNIRuntimeConf(cniParams)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(rt.Args, want) {
+			t.Fatalf("Unexpected args:\n got: %q\nwant: %q", rt.Args, want)
+		}
+	}
+}
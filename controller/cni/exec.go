@@ -0,0 +1,262 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// maxPluginOutput the max number of bytes of the cni-plugins' output
+	// reported in a PluginError, the output's tail is kept
+	maxPluginOutput = 1024
+
+	// pluginWaitDelay how long the output of an exited cni-plugin is read
+	// before its pipes get closed, a process it left behind (e.g. a daemon
+	// in its own session) may hold them open
+	pluginWaitDelay = 2 * time.Second
+)
+
+type operationIDKey struct{}
+type pluginOutputKey struct{}
+
+// WithOperationID returns a context derived off ctx that carries id, the
+// correlation ID of a network attachment operation, along with a logger
+// (see klog.FromContext) tagging its logs with the opID key
+func WithOperationID(ctx context.Context, id string) context.Context {
+	ctx = klog.NewContext(ctx, klog.FromContext(ctx).WithValues("opID", id))
+	return context.WithValue(ctx, operationIDKey{}, id)
+}
+
+// OperationID returns the correlation ID carried by ctx, if any
+func OperationID(ctx context.Context) string {
+	id, _ := ctx.Value(operationIDKey{}).(string)
+	return id
+}
+
+// PluginError the error of a failed cni operation along with the output of
+// the cni-plugins invoked by the operation
+type PluginError struct {
+	Err error
+	// Output what the cni-plugins wrote on stderr, truncated to its tail
+	Output string
+}
+
+func (e *PluginError) Error() string {
+	if e.Output == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v, cni-plugin output: %q", e.Err, e.Output)
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// pluginOutput collects the output of the cni-plugins invoked by an operation
+type pluginOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *pluginOutput) add(pluginPath string, stderr []byte) {
+	if len(bytes.TrimSpace(stderr)) == 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	fmt.Fprintf(&o.buf, "%s: %s\n", filepath.Base(pluginPath), bytes.TrimSpace(stderr))
+}
+
+func (o *pluginOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := strings.TrimSpace(o.buf.String())
+	if len(out) > maxPluginOutput {
+		out = "..." + out[len(out)-maxPluginOutput:]
+	}
+	return out
+}
+
+// withPluginOutput returns a context derived off ctx that collects the
+// output of the cni-plugins invoked with it, and a function wrapping an
+// error in a PluginError carrying that output
+func withPluginOutput(ctx context.Context) (context.Context, func(error) error) {
+	out := &pluginOutput{}
+	return context.WithValue(ctx, pluginOutputKey{}, out), func(err error) error {
+		if err == nil {
+			return nil
+		}
+		return &PluginError{Err: err, Output: out.String()}
+	}
+}
+
+// hostRootDir the host's root filesystem as seen off the podagent's mount
+// namespace, the podagent has to share the host's pid namespace
+const hostRootDir = "/proc/1/root"
+
+// pluginExec the libcni's invoke.Exec used to run the cni-plugins, unlike
+// libcni's default one, a cni-plugin is run in its own process group which
+// get killed as a whole when the invocation's context is done, so that the
+// processes spawned by the cni-plugin (e.g. a delegate or an ipam plugin)
+// don't outlive it
+type pluginExec struct {
+	version.PluginDecoder
+	// nsenterPath if set, the cni-plugins are run through nsenter in the
+	// mount and network namespaces of the host's init process (i.e. PID 1)
+	nsenterPath string
+}
+
+// hostPath returns the path, as seen off the podagent, of a file whose path
+// is path in the cni-plugins' mount namespace
+func (e *pluginExec) hostPath(path string) string {
+	if e.nsenterPath == "" || path == "" {
+		return path
+	}
+	return filepath.Join(hostRootDir, path)
+}
+
+// FindInPath returns the full path of the cni-plugin off paths, with
+// nsenter, the paths are looked up in the host's root filesystem
+func (e *pluginExec) FindInPath(plugin string, paths []string) (string, error) {
+	if e.nsenterPath == "" {
+		return invoke.FindInPath(plugin, paths)
+	}
+	if plugin == "" || strings.ContainsRune(plugin, os.PathSeparator) {
+		return "", fmt.Errorf("invalid plugin name: %q", plugin)
+	}
+	for _, path := range paths {
+		fullpath := filepath.Join(path, plugin)
+		if fi, err := os.Stat(e.hostPath(fullpath)); err == nil && fi.Mode().IsRegular() {
+			return fullpath, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find plugin %q in host path %s", plugin, paths)
+}
+
+// ExecPlugin runs the cni-plugin pluginPath and returns its stdout, an
+// expired context is reported as a cni "try again later" error
+func (e *pluginExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	// retry the command on "text file busy" errors (i.e. the cni-plugin
+	// is being written), as libcni's default exec does
+	for i := 0; ; i++ {
+		stdout, stderr, err := e.run(ctx, pluginPath, stdinData, environ)
+		if out, ok := ctx.Value(pluginOutputKey{}).(*pluginOutput); ok {
+			out.add(pluginPath, stderr)
+		}
+		if err != nil {
+			klog.FromContext(ctx).V(4).Info("cni-plugin failed", "plugin", pluginPath, "err", err, "stdout", string(stdout), "stderr", string(stderr))
+		} else {
+			klog.FromContext(ctx).V(5).Info("cni-plugin succeeded", "plugin", pluginPath, "stdout", string(stdout), "stderr", string(stderr))
+		}
+		switch {
+		case err == nil:
+			return stdout, nil
+		case ctx.Err() != nil:
+			return nil, contextErr(ctx, pluginPath)
+		case strings.Contains(err.Error(), "text file busy") && i < 5:
+			time.Sleep(time.Second)
+		default:
+			return nil, pluginErr(err, stdout, stderr)
+		}
+	}
+}
+
+func (e *pluginExec) run(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, []byte, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	c := exec.Command(pluginPath)
+	if e.nsenterPath != "" {
+		// nsenter execs the cni-plugin once in the namespaces, they share
+		// the process group
+		c = exec.Command(e.nsenterPath, "--target", "1", "--mount", "--net", "--", pluginPath)
+	}
+	c.Env = environ
+	c.Stdin = bytes.NewBuffer(stdinData)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.WaitDelay = pluginWaitDelay
+	if err := c.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := c.Wait()
+		if errors.Is(err, exec.ErrWaitDelay) && c.ProcessState.Success() {
+			// the cni-plugin succeeded, its output got closed
+			err = nil
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return stdout.Bytes(), stderr.Bytes(), err
+	case <-ctx.Done():
+		logger := klog.FromContext(ctx)
+		logger.Info("Killing cni-plugin process group", "plugin", pluginPath, "pid", c.Process.Pid, "reason", ctx.Err())
+		if err := syscall.Kill(-c.Process.Pid, syscall.SIGKILL); err != nil {
+			logger.Error(err, "Failed to kill cni-plugin process group", "plugin", pluginPath)
+		}
+		err := <-done
+		return stdout.Bytes(), stderr.Bytes(), err
+	}
+}
+
+// contextErr returns the error of a cni-plugin invocation whose context is done
+func contextErr(ctx context.Context, pluginPath string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &cnitypes.Error{
+			Code: cnitypes.ErrTryAgainLater,
+			Msg:  fmt.Sprintf("cni-plugin %s timed out", pluginPath),
+		}
+	}
+	return fmt.Errorf("cni-plugin %s: %w", pluginPath, ctx.Err())
+}
+
+// pluginErr returns the error of a failed cni-plugin invocation, it's the
+// one reported by the cni-plugin on stdout, if any
+func pluginErr(err error, stdout, stderr []byte) error {
+	emsg := cnitypes.Error{}
+	if len(stdout) == 0 {
+		if len(stderr) == 0 {
+			emsg.Msg = fmt.Sprintf("netplugin failed with no error message: %v", err)
+		} else {
+			emsg.Msg = fmt.Sprintf("netplugin failed: %q", string(stderr))
+		}
+	} else if perr := json.Unmarshal(stdout, &emsg); perr != nil {
+		emsg.Msg = fmt.Sprintf("netplugin failed but error parsing its diagnostic message %q: %v", string(stdout), perr)
+	}
+	return &emsg
+}
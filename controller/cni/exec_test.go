@@ -0,0 +1,138 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+)
+
+// writePlugin writes an executable shell script cni-plugin
+func writePlugin(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugin")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("Failed to write plugin: %v", err)
+	}
+	return path
+}
+
+func TestExecPluginDaemonizedChild(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid not found")
+	}
+	for _, tc := range []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		// timedOut if set, the cni-plugin times out
+		timedOut bool
+	}{
+		{
+			// the child, in its own session, outlives the process
+			// group kill and holds the plugin's stdout open
+			name:     "timed out",
+			script:   "setsid sleep 5 &\nsleep 5\n",
+			timeout:  200 * time.Millisecond,
+			timedOut: true,
+		},
+		{
+			name:    "exited",
+			script:  "setsid sleep 5 &\necho '{}'\n",
+			timeout: time.Minute,
+		},
+	} {
+		pluginPath := writePlugin(t, tc.script)
+		ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+		start := time.Now()
+		stdout, err := (&pluginExec{}).ExecPlugin(ctx, pluginPath, nil, nil)
+		cancel()
+		if elapsed := time.Since(start); elapsed > pluginWaitDelay+2*time.Second {
+			t.Errorf("%s: the invocation took %v", tc.name, elapsed)
+		}
+		var cniErr *cnitypes.Error
+		if tc.timedOut {
+			if !errors.As(err, &cniErr) || cniErr.Code != cnitypes.ErrTryAgainLater {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || string(stdout) != "{}\n" {
+			t.Errorf("%s: unexpected output %q, %v", tc.name, stdout, err)
+		}
+	}
+}
+
+func TestPluginErr(t *testing.T) {
+	exitErr := errors.New("exit status 1")
+	for _, tc := range []struct {
+		stdout string
+		stderr string
+		want   cnitypes.Error
+	}{
+		{want: cnitypes.Error{Msg: "netplugin failed with no error message: exit status 1"}},
+		{stderr: "boom", want: cnitypes.Error{Msg: `netplugin failed: "boom"`}},
+		{
+			stdout: `{"cniVersion":"0.4.0","code":7,"msg":"invalid config","details":"no bridge"}`,
+			stderr: "boom",
+			want:   cnitypes.Error{Code: cnitypes.ErrInvalidNetworkConfig, Msg: "invalid config", Details: "no bridge"},
+		},
+		{stdout: "panic", want: cnitypes.Error{Msg: `netplugin failed but error parsing its diagnostic message "panic": invalid character 'p' looking for beginning of value`}},
+	} {
+		err := pluginErr(exitErr, []byte(tc.stdout), []byte(tc.stderr))
+		var cniErr *cnitypes.Error
+		if !errors.As(err, &cniErr) || *cniErr != tc.want {
+			t.Errorf("%q, %q: unexpected error %#v, want %#v", tc.stdout, tc.stderr, err, tc.want)
+		}
+	}
+}
+
+func TestPluginOutput(t *testing.T) {
+	ctx, wrap := withPluginOutput(context.Background())
+	if err := wrap(nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	out := ctx.Value(pluginOutputKey{}).(*pluginOutput)
+	out.add("/opt/cni/bin/bridge", []byte(" \n"))
+	out.add("/opt/cni/bin/bridge", []byte("bridge failed\n"))
+	out.add("/opt/cni/bin/host-local", []byte("no more addresses\n"))
+
+	cause := &cnitypes.Error{Code: cnitypes.ErrInvalidNetworkConfig, Msg: "invalid"}
+	err := wrap(cause)
+	var pluginErr *PluginError
+	if !errors.As(err, &pluginErr) || pluginErr.Output != "bridge: bridge failed\nhost-local: no more addresses" {
+		t.Fatalf("Unexpected error %#v", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Fatalf("The error %v doesn't wrap %v", err, cause)
+	}
+
+	// the output's tail is kept
+	out.add("/opt/cni/bin/bridge", []byte(strings.Repeat("x", 2*maxPluginOutput)))
+	got := out.String()
+	if len(got) != len("...")+maxPluginOutput || !strings.HasPrefix(got, "...") || !strings.HasSuffix(got, "xxx") {
+		t.Fatalf("Unexpected truncated output %q", got)
+	}
+}
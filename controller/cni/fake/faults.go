@@ -0,0 +1,172 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+)
+
+// Fault the faults injected in the cni operations of a network, the rates
+// are the fractions, in [0, 1], of the operations affected
+type Fault struct {
+	// Ops the cni operations affected, all of them if empty
+	Ops []Op
+	// FailRate the fraction of operations failing with Err
+	FailRate float64
+	// Err the error of the failing operations, a cni "try again later"
+	// error (i.e. a transient one) if nil
+	Err error
+	// DelayRate the fraction of operations delayed by Delay
+	DelayRate float64
+	Delay     time.Duration
+	// HangRate the fraction of operations hanging until their context is
+	// done, like a cni-plugin that never completes
+	HangRate float64
+}
+
+func (f *Fault) affects(op Op) bool {
+	if len(f.Ops) == 0 {
+		return true
+	}
+	for _, o := range f.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// FaultInjector a cni.Interface wrapping another one, it fails, delays or
+// hangs a fraction of the cni operations of the networks it's given faults for
+type FaultInjector struct {
+	cni.Interface
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	faults map[string]Fault
+}
+
+var _ cni.Interface = &FaultInjector{}
+
+// NewFaultInjector instantiate a FaultInjector wrapping plugin, seed
+// makes the faults injection reproducible
+func NewFaultInjector(plugin cni.Interface, seed int64) *FaultInjector {
+	return &FaultInjector{
+		Interface: plugin,
+		rand:      rand.New(rand.NewSource(seed)),
+		faults:    make(map[string]Fault),
+	}
+}
+
+// SetFault sets the faults injected in the cni operations of network, it's
+// a network name qualified by its namespace (i.e. <namespace>/<name>) when
+// it's not in the Pod's namespace, "" for the networks without faults of
+// their own
+func (f *FaultInjector) SetFault(network string, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[network] = fault
+}
+
+// ClearFaults removes all the faults
+func (f *FaultInjector) ClearFaults() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[string]Fault)
+}
+
+// inject injects the fault, if any, of the network of cniParams in the
+// operation op, a non nil error is returned if the operation fails
+func (f *FaultInjector) inject(ctx context.Context, op Op, cniParams *cni.Parameters) error {
+	network := cniParams.NetworkName
+	if cniParams.NetworkNamespace != "" {
+		network = cniParams.NetworkNamespace + "/" + network
+	}
+
+	f.mu.Lock()
+	fault, ok := f.faults[network]
+	if !ok {
+		fault, ok = f.faults[""]
+	}
+	if !ok || !fault.affects(op) {
+		f.mu.Unlock()
+		return nil
+	}
+	hang := f.rand.Float64() < fault.HangRate
+	delay := f.rand.Float64() < fault.DelayRate
+	fail := f.rand.Float64() < fault.FailRate
+	f.mu.Unlock()
+
+	if hang {
+		klog.FromContext(ctx).Info("fake cni hanging", "call", op)
+		<-ctx.Done()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return &cnitypes.Error{Code: cnitypes.ErrTryAgainLater, Msg: "fake cni-plugin timed out"}
+		}
+		return ctx.Err()
+	}
+	if delay {
+		klog.FromContext(ctx).Info("fake cni delaying", "call", op, "delay", fault.Delay)
+		select {
+		case <-time.After(fault.Delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		err := fault.Err
+		if err == nil {
+			err = &cnitypes.Error{Code: cnitypes.ErrTryAgainLater, Msg: "fake cni-plugin failure"}
+		}
+		klog.FromContext(ctx).Info("fake cni failing", "call", op, "err", err)
+		return err
+	}
+	return nil
+}
+
+// AddNetwork injects the network's fault in a cni ADD
+func (f *FaultInjector) AddNetwork(ctx context.Context, cniParams *cni.Parameters) error {
+	if err := f.inject(ctx, Add, cniParams); err != nil {
+		return err
+	}
+	return f.Interface.AddNetwork(ctx, cniParams)
+}
+
+// DeleteNetwork injects the network's fault in a cni DEL
+func (f *FaultInjector) DeleteNetwork(ctx context.Context, cniParams *cni.Parameters) error {
+	if err := f.inject(ctx, Del, cniParams); err != nil {
+		return err
+	}
+	return f.Interface.DeleteNetwork(ctx, cniParams)
+}
+
+// CheckNetwork injects the network's fault in a cni CHECK
+func (f *FaultInjector) CheckNetwork(ctx context.Context, cniParams *cni.Parameters) error {
+	if err := f.inject(ctx, Check, cniParams); err != nil {
+		return err
+	}
+	return f.Interface.CheckNetwork(ctx, cniParams)
+}
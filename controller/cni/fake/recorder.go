@@ -0,0 +1,114 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides cni.Interface implementations to exercise the
+// podagent without cni-plugins nor network namespaces
+package fake
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+)
+
+// Op a cni operation
+type Op string
+
+const (
+	// Add a cni ADD
+	Add Op = "ADD"
+	// Del a cni DEL
+	Del Op = "DEL"
+	// Check a cni CHECK
+	Check Op = "CHECK"
+)
+
+// Call a cni operation received by a Recorder
+type Call struct {
+	Op     Op
+	Params cni.Parameters
+	Time   time.Time
+}
+
+// Recorder a cni.Interface that records and logs the cni operations it
+// receives, they all succeed
+type Recorder struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+var _ cni.Interface = &Recorder{}
+
+// NewRecorder instantiate a Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) record(ctx context.Context, op Op, cniParams *cni.Parameters) {
+	klog.FromContext(ctx).Info("fake cni", "call", op, "params", *cniParams)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{Op: op, Params: *cniParams, Time: time.Now()})
+}
+
+// Calls returns the cni operations received so far, in order
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// Reset forgets the cni operations received so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+}
+
+// AddNetwork records a cni ADD
+func (r *Recorder) AddNetwork(ctx context.Context, cniParams *cni.Parameters) error {
+	r.record(ctx, Add, cniParams)
+	return nil
+}
+
+// DeleteNetwork records a cni DEL
+func (r *Recorder) DeleteNetwork(ctx context.Context, cniParams *cni.Parameters) error {
+	r.record(ctx, Del, cniParams)
+	return nil
+}
+
+// CheckNetwork records a cni CHECK
+func (r *Recorder) CheckNetwork(ctx context.Context, cniParams *cni.Parameters) error {
+	r.record(ctx, Check, cniParams)
+	return nil
+}
+
+// ReleaseLeakedNetworks does nothing, the Recorder has no cache
+func (r *Recorder) ReleaseLeakedNetworks(ctx context.Context, sandboxExists func(sandboxID string) bool, minAge time.Duration) {
+}
+
+// SyncNetworkConfig does nothing
+func (r *Recorder) SyncNetworkConfig() {
+}
+
+// Ready returns no error
+func (r *Recorder) Ready() error {
+	return nil
+}
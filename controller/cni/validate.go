@@ -0,0 +1,71 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+)
+
+// validate checks that every plugin of the network resolves to an
+// executable off the network's path and that it supports the network's cni
+// version (i.e. off the plugin's VERSION command)
+func (n *cniNetwork) validate(ctx context.Context) error {
+	cniVersion := n.NetworkConfig.CNIVersion
+	if cniVersion == "" {
+		cniVersion = "0.1.0"
+	}
+	var errs []string
+	for _, p := range n.NetworkConfig.Plugins {
+		if err := n.validatePlugin(ctx, p.Network.Type, cniVersion); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (n *cniNetwork) validatePlugin(ctx context.Context, pluginType, cniVersion string) error {
+	pluginPath, err := n.exec.FindInPath(pluginType, n.path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(n.exec.hostPath(pluginPath))
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("plugin %s (%s) is not executable", pluginType, pluginPath)
+	}
+	vi, err := invoke.GetVersionInfo(ctx, pluginPath, n.exec)
+	if err != nil {
+		return fmt.Errorf("failed to get plugin %s (%s) version info: %v", pluginType, pluginPath, err)
+	}
+	for _, v := range vi.SupportedVersions() {
+		if v == cniVersion {
+			return nil
+		}
+	}
+	return fmt.Errorf("plugin %s (%s) doesn't support cni version %s (supported: %s)",
+		pluginType, pluginPath, cniVersion, strings.Join(vi.SupportedVersions(), ", "))
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/libcni"
+)
+
+func TestValidateNetwork(t *testing.T) {
+	binDir := t.TempDir()
+	for name, mode := range map[string]os.FileMode{"bridge": 0755, "host-local": 0755, "noexec": 0644} {
+		script := "#!/bin/sh\necho '{\"cniVersion\":\"0.4.0\",\"supportedVersions\":[\"0.3.1\",\"0.4.0\"]}'\n"
+		if err := os.WriteFile(filepath.Join(binDir, name), []byte(script), mode); err != nil {
+			t.Fatalf("Failed to write plugin %s: %v", name, err)
+		}
+	}
+	for _, tc := range []struct {
+		name       string
+		cniVersion string
+		plugins    []string
+		errs       []string
+	}{
+		{name: "valid", cniVersion: "0.4.0", plugins: []string{"bridge", "host-local"}},
+		{name: "missing plugin", cniVersion: "0.4.0", plugins: []string{"bridge", "macvlan"}, errs: []string{`"macvlan"`}},
+		{name: "not executable", cniVersion: "0.4.0", plugins: []string{"noexec"}, errs: []string{"plugin noexec", "is not executable"}},
+		{name: "unsupported version", cniVersion: "1.0.0", plugins: []string{"bridge"}, errs: []string{"doesn't support cni version 1.0.0 (supported: 0.3.1, 0.4.0)"}},
+		{
+			name: "every plugin", cniVersion: "1.0.0", plugins: []string{"bridge", "macvlan"},
+			errs: []string{"doesn't support cni version 1.0.0", `"macvlan"`},
+		},
+	} {
+		var plugins []string
+		for _, p := range tc.plugins {
+			plugins = append(plugins, fmt.Sprintf(`{"type":%q}`, p))
+		}
+		conf, err := libcni.ConfListFromBytes([]byte(fmt.Sprintf(`{"cniVersion":%q,"name":"test","plugins":[%s]}`,
+			tc.cniVersion, strings.Join(plugins, ","))))
+		if err != nil {
+			t.Fatalf("%s: failed to parse the config: %v", tc.name, err)
+		}
+		n := &cniNetwork{name: "test", NetworkConfig: conf, path: []string{binDir}, exec: &pluginExec{}}
+		err = n.validate(context.Background())
+		if len(tc.errs) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		for _, want := range tc.errs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: expected error %q, got: %v", tc.name, want, err)
+			}
+		}
+	}
+}
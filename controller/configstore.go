@@ -21,10 +21,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"reflect"
+	"strings"
 	"sync"
 
-	"github.com/golang/glog"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -50,12 +50,20 @@ const (
 	Nil    RunningState = "Nil"
 	Active RunningState = "Active"
 	Dirty  RunningState = "Dirty"
+	// Failed the network attachment failed with a permanent error (e.g. an
+	// invalid network config), it's not retried until it's changed
+	Failed RunningState = "Failed"
 )
 
 // RunningConfig struct
 type RunningConfig struct {
 	State RunningState
 	Data  interface{}
+	// Reason the error of a Failed network attachment
+	Reason string `json:",omitempty"`
+	// OperationID the correlation ID of the last operation on the network
+	// attachment, it tags the podagent's logs and events of the operation
+	OperationID string `json:",omitempty"`
 }
 
 type ConfigRecord struct {
@@ -67,23 +75,110 @@ type ConfigRecord struct {
 type ConfigStore struct {
 	mu  sync.Mutex
 	dir string
+	// pods the record keys indexed by Pod key (i.e. namespace/name), so
+	// that a Pod's records are read without listing the store
+	pods map[string]map[string]bool
 }
 
 // newConfigStore will create a new config store
 func newConfigStore() *ConfigStore {
-	return &ConfigStore{dir: defaultConfigDir}
+	return &ConfigStore{dir: defaultConfigDir, pods: make(map[string]map[string]bool)}
 }
 
-func (cs *ConfigStore) getConfigRecordKey(podName, networkName string) string {
-	return fmt.Sprintf("%s-%s.json", podName, networkName)
+// getConfigRecordKey returns the key of the record of the network
+// attachment networkName of the Pod namespace/podName, i.e.
+// <namespace>_<podName>_<networkName>.json
+func (cs *ConfigStore) getConfigRecordKey(namespace, podName, networkName string) string {
+	// neither a namespace nor a Pod's name can hold a '_', networkName is
+	// qualified by its namespace (i.e. <namespace>/<name>) when the network
+	// isn't in the Pod's namespace
+	return fmt.Sprintf("%s_%s_%s.json", namespace, podName, strings.ReplaceAll(networkName, "/", "_"))
 }
 
-func (cs *ConfigStore) isConfigSame(expected ExpectedConfig, running RunningConfig) bool {
-	return reflect.DeepEqual(expected.Data, running.Data)
+// getRecordPodKey returns the key of the Pod (i.e. namespace/name) of the
+// record key, false if key isn't a record key
+func getRecordPodKey(key string) (string, bool) {
+	if filepath.Ext(key) != ".json" {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimSuffix(key, ".json"), "_", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", false
+	}
+	return parts[0] + "/" + parts[1], true
+}
+
+// indexConfigRecord adds the record key to the Pods' index, cs.mu must be held
+func (cs *ConfigStore) indexConfigRecord(key string) {
+	podKey, ok := getRecordPodKey(key)
+	if !ok {
+		return
+	}
+	if cs.pods[podKey] == nil {
+		cs.pods[podKey] = make(map[string]bool)
+	}
+	cs.pods[podKey][key] = true
+}
+
+// load indexes the records of the store by Pod, the records saved by
+// older podagent versions, whose key is <podName>-<networkName>.json, are
+// renamed after their Pod's namespace
+func (cs *ConfigStore) load() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	files, err := os.ReadDir(cs.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read config directory(%q): %w", cs.dir, err)
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		key := f.Name()
+		if _, ok := getRecordPodKey(key); !ok {
+			key, err = cs.migrateConfigRecord(key)
+			if err != nil {
+				klog.ErrorS(err, "Failed to migrate config record", "key", f.Name())
+				continue
+			}
+		}
+		cs.indexConfigRecord(key)
+	}
+	return nil
+}
+
+// migrateConfigRecord renames the record of an older podagent version
+// after its Pod's namespace and returns its new key, cs.mu must be held
+func (cs *ConfigStore) migrateConfigRecord(key string) (string, error) {
+	path := filepath.Join(cs.dir, key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read config data from the path(%q): %w", path, err)
+	}
+	var currConfigRec ConfigRecord
+	if err := json.Unmarshal(data, &currConfigRec); err != nil {
+		return "", fmt.Errorf("error unmarshalling config data from the path(%q): %w", path, err)
+	}
+	cniParams, err := getCNIParams(currConfigRec.Expected.Data)
+	if err != nil || cniParams.PodName == "" {
+		cniParams, err = getCNIParams(currConfigRec.Running.Data)
+		if err != nil || cniParams.PodName == "" {
+			return "", fmt.Errorf("config record of the path(%q) has no Pod", path)
+		}
+	}
+	newKey := cs.getConfigRecordKey(cniParams.Namespace, cniParams.PodName, getAttachmentName(cniParams.NetworkNamespace, cniParams.NetworkName))
+	if err := os.Rename(path, filepath.Join(cs.dir, newKey)); err != nil {
+		return "", fmt.Errorf("failed to rename config record(%q): %w", path, err)
+	}
+	klog.InfoS("Migrated config record", "key", key, "newKey", newKey)
+	return newKey, nil
 }
 
 func (cs *ConfigStore) saveRunningConfig(key string, running RunningConfig) error {
-	glog.V(3).Infof("Saving running config:%+v, with Key: %s", running, key)
+	klog.V(3).InfoS("Saving running config", "key", key, "running", running)
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 	var currConfigRec ConfigRecord
@@ -116,7 +211,7 @@ func (cs *ConfigStore) saveRunningConfig(key string, running RunningConfig) erro
 }
 
 func (cs *ConfigStore) saveExpectedConfig(key string, expected ExpectedConfig) error {
-	glog.V(3).Infof("Saving expected config:%+v, with Key: %s", expected, key)
+	klog.V(3).InfoS("Saving expected config", "key", key, "expected", expected)
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 	currConfigRec := ConfigRecord{
@@ -148,6 +243,7 @@ func (cs *ConfigStore) saveExpectedConfig(key string, expected ExpectedConfig) e
 	if err != nil {
 		return fmt.Errorf("failed to write config data in the path(%q): %w", path, err)
 	}
+	cs.indexConfigRecord(key)
 
 	return nil
 }
@@ -171,14 +267,90 @@ func (cs *ConfigStore) getConfigRecord(key string) (ConfigRecord, error) {
 		return ConfigRecord{}, fmt.Errorf("error unmarshalling config data from the path(%q): %w", path, err)
 	}
 
-	glog.V(3).Infof("Returning configRecord:%+v, with Key: %s", currConfigRec, key)
+	klog.V(3).InfoS("Returning config record", "key", key, "record", currConfigRec)
 	return currConfigRec, nil
 }
 
 func (cs *ConfigStore) delConfigRecord(key string) error {
-	glog.V(3).Infof("Deleting configRecord with Key: %s", key)
+	klog.V(3).InfoS("Deleting config record", "key", key)
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 	path := filepath.Join(cs.dir, key)
-	return os.Remove(path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if podKey, ok := getRecordPodKey(key); ok {
+		delete(cs.pods[podKey], key)
+		if len(cs.pods[podKey]) == 0 {
+			delete(cs.pods, podKey)
+		}
+	}
+	return nil
+}
+
+// listPodConfigRecords returns the records of the Pod podKey (i.e.
+// namespace/name) keyed by record key
+func (cs *ConfigStore) listPodConfigRecords(podKey string) map[string]ConfigRecord {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cfgRecords := make(map[string]ConfigRecord)
+	for key := range cs.pods[podKey] {
+		path := filepath.Join(cs.dir, key)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			klog.ErrorS(err, "Failed to read config data", "path", path)
+			continue
+		}
+		var currConfigRec ConfigRecord
+		if err := json.Unmarshal(data, &currConfigRec); err != nil {
+			klog.ErrorS(err, "Failed to unmarshal config data", "path", path)
+			continue
+		}
+		cfgRecords[key] = currConfigRec
+	}
+	return cfgRecords
+}
+
+// listPods returns the keys (i.e. namespace/name) of the Pods having records
+func (cs *ConfigStore) listPods() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	podKeys := make([]string, 0, len(cs.pods))
+	for podKey := range cs.pods {
+		podKeys = append(podKeys, podKey)
+	}
+	return podKeys
+}
+
+// listConfigRecords returns all the records in the store keyed by record key
+func (cs *ConfigStore) listConfigRecords() (map[string]ConfigRecord, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	files, err := os.ReadDir(cs.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]ConfigRecord{}, nil
+		}
+		return nil, fmt.Errorf("failed to read config directory(%q): %w", cs.dir, err)
+	}
+
+	cfgRecords := make(map[string]ConfigRecord)
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(cs.dir, f.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			klog.ErrorS(err, "Failed to read config data", "path", path)
+			continue
+		}
+		var currConfigRec ConfigRecord
+		if err := json.Unmarshal(data, &currConfigRec); err != nil {
+			klog.ErrorS(err, "Failed to unmarshal config data", "path", path)
+			continue
+		}
+		cfgRecords[f.Name()] = currConfigRec
+	}
+	return cfgRecords, nil
 }
@@ -0,0 +1,90 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+)
+
+func TestGetRecordPodKey(t *testing.T) {
+	cs := newConfigStore()
+	for _, tc := range []struct {
+		key    string
+		podKey string
+		ok     bool
+	}{
+		{key: cs.getConfigRecordKey("default", "db-0", "green"), podKey: "default/db-0", ok: true},
+		{key: cs.getConfigRecordKey("default", "db.0", "other/green"), podKey: "default/db.0", ok: true},
+		// the keys of older podagent versions
+		{key: "db-0-green.json"},
+		{key: "db-0-other_green.json"},
+		{key: "default_db-0_green.tmp"},
+	} {
+		podKey, ok := getRecordPodKey(tc.key)
+		if podKey != tc.podKey || ok != tc.ok {
+			t.Errorf("%s: unexpected pod key %q, %v, want %q, %v", tc.key, podKey, ok, tc.podKey, tc.ok)
+		}
+	}
+}
+
+func TestConfigStoreMigration(t *testing.T) {
+	cs := newConfigStore()
+	cs.dir = t.TempDir()
+	for key, cniParams := range map[string]cni.Parameters{
+		"db-0-green.json":       {Namespace: "default", PodName: "db-0", NetworkName: "green"},
+		"db-0-other_green.json": {Namespace: "default", PodName: "db-0", NetworkName: "green", NetworkNamespace: "other"},
+	} {
+		data, err := json.Marshal(ConfigRecord{
+			Expected: ExpectedConfig{Optype: Add, Data: cniParams},
+			Running:  RunningConfig{State: Active, Data: cniParams},
+		})
+		if err != nil {
+			t.Fatalf("Failed to encode record: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(cs.dir, key), data, 0600); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+	if err := cs.load(); err != nil {
+		t.Fatalf("Failed to load the store: %v", err)
+	}
+
+	cfgRecords := cs.listPodConfigRecords("default/db-0")
+	for _, key := range []string{"default_db-0_green.json", "default_db-0_other_green.json"} {
+		if _, ok := cfgRecords[key]; !ok {
+			t.Errorf("Record %s not migrated, got %v", key, cfgRecords)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cs.dir, "db-0-green.json")); !os.IsNotExist(err) {
+		t.Errorf("Record of an older version left behind: %v", err)
+	}
+
+	if err := cs.delConfigRecord("default_db-0_green.json"); err != nil {
+		t.Fatalf("Failed to delete record: %v", err)
+	}
+	if err := cs.delConfigRecord("default_db-0_other_green.json"); err != nil {
+		t.Fatalf("Failed to delete record: %v", err)
+	}
+	if podKeys := cs.listPods(); len(podKeys) != 0 {
+		t.Errorf("Unexpected indexed pods %v", podKeys)
+	}
+}
@@ -20,14 +20,23 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/kaloom/kubernetes-podagent/controller/cni"
 	ccri "github.com/kaloom/kubernetes-podagent/controller/crio-runtime"
 
-	"github.com/golang/glog"
-
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
 )
 
 // ContainerType defines the type if continer used to support the pods
@@ -48,18 +57,47 @@ func (ct ContainerType) String() string {
 	case Crio:
 		return "Crio"
 	default:
-		glog.Errorf("Invalid ContainerType: %d", int(ct))
+		klog.ErrorS(nil, "Invalid ContainerType", "containerType", int(ct))
 		return fmt.Sprintf("%d", int(ct))
 	}
 }
 
 // Controller the controller object
 type Controller struct {
-	kubeClient  *kubernetes.Clientset
-	runtime     Runtime
-	cniPlugin   *cni.NetworkPlugin
-	eventQueue  *EventQueue
-	configStore *ConfigStore
+	kubeClient    kubernetes.Interface
+	dynamicClient dynamic.Interface
+	recorder      record.EventRecorder
+	runtime       Runtime
+	cniPlugin     cni.Interface
+	eventQueue    *EventQueue
+	configStore   *ConfigStore
+	podLister     corelisters.PodLister
+	podsSynced    cache.InformerSynced
+	// podsCacheSynced set once the Pods' cache is synced, unlike podsSynced
+	// it can be read before the Pods' informer is created
+	podsCacheSynced atomic.Bool
+	// networkLister the cache of kaloom Networks, used to validate
+	// the networks referred to by Pods
+	networkLister          cache.GenericLister
+	networksSynced         cache.InformerSynced
+	networkInformerFactory dynamicinformer.DynamicSharedInformerFactory
+	resyncPeriod           time.Duration
+	// checkPeriod the period of the cni CHECK of the active network
+	// attachments, 0 to disable it
+	checkPeriod time.Duration
+	// directDelegate if set, the kaloom Networks' cni config is invoked
+	// directly instead of going through kactus
+	directDelegate bool
+	// statuses writes the Pods' networks readiness gate condition and
+	// networks status annotation
+	statuses *statusUpdater
+	// podSelection the Pods managed by the podagent
+	podSelection *podSelection
+	// podSource the source of the Pods, if nil they're watched on the
+	// apiserver
+	podSource podSource
+	// metrics the metrics served by MetricsHandler
+	metrics *metrics
 }
 
 // Run starts a Pod resource controller
@@ -70,46 +108,186 @@ func (c *Controller) Run(ctx context.Context, nodeName string) error {
 	} else {
 		where = "node: " + nodeName
 	}
-	glog.Infof("Pod's resource controller watching on %s", where)
+	klog.InfoS("Pod's resource controller watching", "on", where)
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: c.kubeClient.CoreV1().Events("")})
+	defer eventBroadcaster.Shutdown()
+	defer c.statuses.stop()
+	c.recorder = eventBroadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: "podagent", Host: nodeName})
 
+	// Watch kaloom Network objects, ahead of the Pods so that their
+	// networks are validated
+	if c.networkInformerFactory != nil {
+		c.watchNetworks(ctx)
+	}
 	// Watch Pod objects
-	_, err := c.watchPods(ctx, nodeName)
+	err := c.watchPods(ctx, nodeName)
 	if err != nil {
-		glog.Errorf("Failed to register watch for Pod resource: %v", err)
+		klog.ErrorS(err, "Failed to register watch for Pod resource")
 		return err
 	}
+	// the cni config is reloaded and its plugins validated again
+	go wait.Until(c.cniPlugin.SyncNetworkConfig, c.resyncPeriod, ctx.Done())
 
 	<-ctx.Done()
 	return ctx.Err()
 }
 
-// NewController instantiate a docker controller object
-func NewController(kubeClient *kubernetes.Clientset, endpoint, cniBinPath, cniConfPath, cniVendor string, containerType ContainerType) (*Controller, error) {
-	runtimeRequestTimeout := 2 * time.Minute
+// Ready returns an error if the controller isn't ready to attach networks
+// to Pods, i.e. its cni config is missing or invalid or its Pods' cache
+// isn't synced yet
+func (c *Controller) Ready() error {
+	if err := c.cniPlugin.Ready(); err != nil {
+		return fmt.Errorf("cni: %v", err)
+	}
+	if !c.podsCacheSynced.Load() {
+		return fmt.Errorf("pods cache not synced")
+	}
+	return nil
+}
 
-	var runTime Runtime
-	var err error
-	switch containerType {
-	case Crio:
-		runTime, err = ccri.NewCrioRuntime(endpoint, runtimeRequestTimeout)
+// Options the options of a controller
+type Options struct {
+	KubeClient kubernetes.Interface
+	// DynamicClient the client of the kaloom Networks and of the
+	// NetworkAttachmentDefinitions, if nil the former are neither watched
+	// nor validated and the latter can't be attached
+	DynamicClient dynamic.Interface
+	// Runtime the container runtime, if nil it's created off
+	// ContainerType and Endpoint
+	Runtime       Runtime
+	ContainerType ContainerType
+	Endpoint      string
+	// CNIPlugin the cni operations, if nil a cni.NetworkPlugin is created
+	// off the CNI* options and UseNsenter
+	CNIPlugin   cni.Interface
+	CNIBinPath  string
+	CNIConfPath string
+	CNIVendor   string
+	CNITimeout  time.Duration
+	UseNsenter  bool
+	// ConfigDir the directory of the ConfigStore, defaults to
+	// /var/run/podagent/configstore/
+	ConfigDir    string
+	ResyncPeriod time.Duration
+	// CheckPeriod the period of the cni CHECK of the active network
+	// attachments, 0 to disable it
+	CheckPeriod time.Duration
+	// DirectDelegate if set, the kaloom Networks' cni config is invoked
+	// directly instead of going through kactus
+	DirectDelegate bool
+	// StatusInterval the min interval between two writes of a Pod's
+	// networks status annotation and readiness gate condition, defaults
+	// to 5s
+	StatusInterval time.Duration
+	// PodLabelSelector the label selector of the Pods managed by the
+	// podagent (e.g. podagent.kaloom.com/managed=true), empty for all Pods
+	PodLabelSelector string
+	// Namespaces the namespaces of the Pods managed by the podagent, empty
+	// for all of them but ExcludedNamespaces
+	Namespaces []string
+	// ExcludedNamespaces the namespaces whose Pods aren't managed by the
+	// podagent
+	ExcludedNamespaces []string
+	// Kubelet if its URL is set, the Pods are polled off the kubelet
+	// rather than watched on the apiserver
+	Kubelet KubeletOptions
+	// RetryDelay the delay before retrying a network attachment that failed
+	// with a transient error, doubled on every consecutive failure up to
+	// MaxRetryDelay, they default to 1s and 5m
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
 
-	default:
-		glog.Error("docker runtime has been disabled, please use crio")
-	}
+// ReloadableOptions the options that can be changed while the controller
+// is running, the other ones require a restart
+type ReloadableOptions struct {
+	StatusInterval time.Duration
+	RetryDelay     time.Duration
+	MaxRetryDelay  time.Duration
+}
+
+// NewController instantiate a controller object
+func NewController(opts Options) (*Controller, error) {
+	runtimeRequestTimeout := 2 * time.Minute
+
+	podSelection, err := newPodSelection(opts.PodLabelSelector, opts.Namespaces, opts.ExcludedNamespaces)
 	if err != nil {
 		return nil, err
 	}
 
-	cniPlugin, err := cni.NewCNIPlugin(cniBinPath, cniConfPath, cniVendor)
-	if err != nil {
+	runTime := opts.Runtime
+	if runTime == nil {
+		switch opts.ContainerType {
+		case Crio:
+			runTime, err = ccri.NewCrioRuntime(opts.Endpoint, runtimeRequestTimeout)
+
+		default:
+			klog.ErrorS(nil, "docker runtime has been disabled, please use crio")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cniPlugin := opts.CNIPlugin
+	if cniPlugin == nil {
+		cniPlugin, err = cni.NewCNIPlugin(opts.CNIBinPath, opts.CNIConfPath, opts.CNIVendor, opts.CNITimeout, opts.UseNsenter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	configStore := newConfigStore()
+	if opts.ConfigDir != "" {
+		configStore.dir = opts.ConfigDir
+	}
+	if err := configStore.load(); err != nil {
 		return nil, err
 	}
 	c := &Controller{
-		kubeClient:  kubeClient,
-		runtime:     runTime,
-		cniPlugin:   cniPlugin,
-		eventQueue:  newQueue(),
-		configStore: newConfigStore(),
+		kubeClient:     opts.KubeClient,
+		dynamicClient:  opts.DynamicClient,
+		runtime:        runTime,
+		cniPlugin:      cniPlugin,
+		eventQueue:     newQueue(),
+		configStore:    configStore,
+		resyncPeriod:   opts.ResyncPeriod,
+		checkPeriod:    opts.CheckPeriod,
+		directDelegate: opts.DirectDelegate,
+		podSelection:   podSelection,
 	}
+	c.metrics = newMetrics(c.configStore, c.eventQueue)
+	if c.dynamicClient != nil {
+		c.newNetworkInformer()
+	}
+	if opts.Kubelet.URL != "" {
+		c.podSource, err = newKubeletPodSource(opts.Kubelet, podSelection, opts.ResyncPeriod)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.statuses = newStatusUpdater(defaultStatusInterval, c.writePodStatus)
+	c.Reload(ReloadableOptions{
+		StatusInterval: opts.StatusInterval,
+		RetryDelay:     opts.RetryDelay,
+		MaxRetryDelay:  opts.MaxRetryDelay,
+	})
 	return c, nil
 }
+
+// Reload applies opts to the running controller, their zero values are
+// replaced by the defaults
+func (c *Controller) Reload(opts ReloadableOptions) {
+	if opts.StatusInterval == 0 {
+		opts.StatusInterval = defaultStatusInterval
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = retryDelay
+	}
+	if opts.MaxRetryDelay == 0 {
+		opts.MaxRetryDelay = maxRetryDelay
+	}
+	c.statuses.setInterval(opts.StatusInterval)
+	c.eventQueue.setRetryPolicy(opts.RetryDelay, opts.MaxRetryDelay)
+}
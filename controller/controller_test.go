@@ -0,0 +1,828 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/kaloom/kubernetes-podagent/controller"
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+	"github.com/kaloom/kubernetes-podagent/controller/cni/fake"
+	fakeruntime "github.com/kaloom/kubernetes-podagent/controller/fake-runtime"
+)
+
+const (
+	testNode      = "node-1"
+	testNamespace = "default"
+	testTimeout   = 10 * time.Second
+	// testSettle how long no more cni calls than the expected ones must
+	// be seen
+	testSettle = 300 * time.Millisecond
+	// networksReadyCondition the podagent's readiness gate condition
+	networksReadyCondition = apiv1.PodConditionType("podagent.kaloom.com/networks-ready")
+)
+
+// harness runs a controller off a fake clientset, a fake runtime and a
+// recording cni plugin, the Pods are driven through the clientset and the
+// cni calls are asserted off the recorder
+type harness struct {
+	t       *testing.T
+	ctrl    *controller.Controller
+	client  *k8sfake.Clientset
+	runtime *fakeruntime.FakeRuntime
+	cni     *fake.Recorder
+	faults  *fake.FaultInjector
+	// namespace the namespace of the Pods, testNamespace by default
+	namespace string
+	// seen the number of cni calls already asserted
+	seen int
+}
+
+// newHarness starts a controller, setOpts if any are applied on its options
+func newHarness(t *testing.T, setOpts ...func(*controller.Options)) *harness {
+	h := &harness{
+		t:         t,
+		client:    k8sfake.NewSimpleClientset(),
+		runtime:   fakeruntime.NewFakeRuntime(),
+		cni:       fake.NewRecorder(),
+		namespace: testNamespace,
+	}
+	// the failed cni operations aren't recorded
+	h.faults = fake.NewFaultInjector(h.cni, 1)
+	opts := controller.Options{
+		KubeClient:     h.client,
+		Runtime:        h.runtime,
+		CNIPlugin:      h.faults,
+		ConfigDir:      t.TempDir(),
+		ResyncPeriod:   time.Hour,
+		StatusInterval: 10 * time.Millisecond,
+	}
+	for _, setOpt := range setOpts {
+		setOpt(&opts)
+	}
+	c, err := controller.NewController(opts)
+	if err != nil {
+		t.Fatalf("Failed to create the controller: %v", err)
+	}
+	h.ctrl = c
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx, testNode)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, testTimeout, true, func(context.Context) (bool, error) {
+		return c.Ready() == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Controller not ready: %v", err)
+	}
+	return h
+}
+
+// createPod creates a running Pod whose container containerID is in the
+// sandbox sandboxID, with networks as its networks annotation
+func (h *harness) createPod(name, containerID, sandboxID, networks string) {
+	pod := h.newPod(name, containerID, sandboxID, networks)
+	_, err := h.client.CoreV1().Pods(h.namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+	if err != nil {
+		h.t.Fatalf("Failed to create pod %s: %v", name, err)
+	}
+}
+
+// newPod returns a running Pod whose container containerID is in the
+// sandbox sandboxID, added to the runtime, with networks as its networks
+// annotation
+func (h *harness) newPod(name, containerID, sandboxID, networks string) *apiv1.Pod {
+	h.runtime.AddContainer(containerID, sandboxID, "/var/run/netns/"+sandboxID)
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   h.namespace,
+			UID:         types.UID("uid-" + sandboxID),
+			Annotations: map[string]string{"networks": networks},
+		},
+		Spec: apiv1.PodSpec{NodeName: testNode},
+		Status: apiv1.PodStatus{
+			Phase:             apiv1.PodRunning,
+			ContainerStatuses: []apiv1.ContainerStatus{{ContainerID: "cri-o://" + containerID}},
+		},
+	}
+}
+
+// annotatePod sets the networks annotation of the Pod name to networks
+func (h *harness) annotatePod(name, networks string) {
+	pod, err := h.client.CoreV1().Pods(h.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		h.t.Fatalf("Failed to get pod %s: %v", name, err)
+	}
+	pod.Annotations["networks"] = networks
+	_, err = h.client.CoreV1().Pods(h.namespace).Update(context.TODO(), pod, metav1.UpdateOptions{})
+	if err != nil {
+		h.t.Fatalf("Failed to update pod %s: %v", name, err)
+	}
+}
+
+func (h *harness) deletePod(name string) {
+	err := h.client.CoreV1().Pods(h.namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil {
+		h.t.Fatalf("Failed to delete pod %s: %v", name, err)
+	}
+}
+
+// expectCalls asserts that the cni calls following the ones already
+// asserted are exactly want, each formatted as "<op> <pod> <network>"
+func (h *harness) expectCalls(want ...string) []fake.Call {
+	h.t.Helper()
+	var calls []fake.Call
+	_ = wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, testTimeout, true, func(context.Context) (bool, error) {
+		calls = h.cni.Calls()[h.seen:]
+		return len(calls) >= len(want), nil
+	})
+	// no other calls are expected
+	time.Sleep(testSettle)
+	calls = h.cni.Calls()[h.seen:]
+
+	got := make([]string, 0, len(calls))
+	for _, call := range calls {
+		got = append(got, fmt.Sprintf("%s %s %s", call.Op, call.Params.PodName, call.Params.NetworkName))
+	}
+	if len(want) == 0 {
+		want = []string{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		h.t.Fatalf("Unexpected cni calls:\n got: %q\nwant: %q", got, want)
+	}
+	h.seen += len(calls)
+	return calls
+}
+
+func TestNetworkAttachmentsLifecycle(t *testing.T) {
+	h := newHarness(t)
+
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	calls := h.expectCalls("ADD vnf green")
+	want := cni.Parameters{
+		Namespace:   testNamespace,
+		PodName:     "vnf",
+		PodUID:      "uid-s1",
+		ContainerID: "c1",
+		SandboxID:   "s1",
+		NetnsPath:   "/var/run/netns/s1",
+		NetworkName: "green",
+	}
+	if !reflect.DeepEqual(calls[0].Params, want) {
+		t.Fatalf("Unexpected cni parameters:\n got: %+v\nwant: %+v", calls[0].Params, want)
+	}
+
+	// a network is added
+	h.annotatePod("vnf", `[{"name":"green"},{"name":"red","interface":"data0"}]`)
+	calls = h.expectCalls("ADD vnf red")
+	if calls[0].Params.IfName != "data0" {
+		t.Fatalf("Unexpected interface name %q, want data0", calls[0].Params.IfName)
+	}
+
+	// a network is changed, it's deleted then added back
+	h.annotatePod("vnf", `[{"name":"green","ifMac":"02:00:00:00:00:01"},{"name":"red","interface":"data0"}]`)
+	calls = h.expectCalls("DEL vnf green", "ADD vnf green")
+	if calls[0].Params.IfMAC != "" || calls[1].Params.IfMAC != "02:00:00:00:00:01" {
+		t.Fatalf("Unexpected macs, DEL: %q, ADD: %q", calls[0].Params.IfMAC, calls[1].Params.IfMAC)
+	}
+
+	// a resync of an unchanged annotation is a no-op
+	h.annotatePod("vnf", `[{"name":"green","ifMac":"02:00:00:00:00:01"},{"name":"red","interface":"data0"}]`)
+	h.expectCalls()
+
+	// a network is removed
+	h.annotatePod("vnf", `[{"name":"red","interface":"data0"}]`)
+	h.expectCalls("DEL vnf green")
+
+	// the networks of a deleted pod are released
+	h.deletePod("vnf")
+	calls = h.expectCalls("DEL vnf red")
+	if calls[0].Params.IfName != "data0" || calls[0].Params.SandboxID != "s1" {
+		t.Fatalf("Unexpected cni parameters of the deleted pod: %+v", calls[0].Params)
+	}
+}
+
+func TestInvalidNetworkAttachments(t *testing.T) {
+	h := newHarness(t)
+
+	// the primary, skipped, duplicated and colliding networks are ignored
+	h.createPod("vnf", "c1", "s1", `[
+		{"name":"default","isPrimary":true},
+		{"name":"skipped","podagentSkip":true},
+		{"name":"green","interface":"data0"},
+		{"name":"green","interface":"data1"},
+		{"name":"red","interface":"data0"},
+		{"name":"blue","interface":"eth0"}
+	]`)
+	h.expectCalls("ADD vnf green")
+
+	h.deletePod("vnf")
+	h.expectCalls("DEL vnf green")
+}
+
+func TestNetworkAttachmentDefinition(t *testing.T) {
+	nad := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "k8s.cni.cncf.io/v1",
+		"kind":       "NetworkAttachmentDefinition",
+		"metadata":   map[string]interface{}{"name": "green", "namespace": testNamespace},
+		"spec":       map[string]interface{}{"config": `{"cniVersion":"0.4.0","type":"bridge"}`},
+	}}
+	nadGVR := schema.GroupVersionResource{Group: "k8s.cni.cncf.io", Version: "v1", Resource: "network-attachment-definitions"}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "kaloom.com", Version: "v1", Resource: "networks"}: "NetworkList",
+		nadGVR: "NetworkAttachmentDefinitionList",
+	})
+	// the resource isn't guessed off the kind as its plural is hyphenated
+	if _, err := dynamicClient.Resource(nadGVR).Namespace(testNamespace).Create(context.TODO(), nad, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create the NetworkAttachmentDefinition: %v", err)
+	}
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.DynamicClient = dynamicClient
+	})
+
+	// the missing red network doesn't get attached
+	pod := h.newPod("vnf", "c1", "s1", "")
+	pod.Annotations = map[string]string{"k8s.v1.cni.cncf.io/networks": "green@net1,red"}
+	if _, err := h.client.CoreV1().Pods(h.namespace).Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create pod: %v", err)
+	}
+	calls := h.expectCalls("ADD vnf green")
+	// the config is named after its NetworkAttachmentDefinition
+	want := `{"cniVersion":"0.4.0","name":"green","type":"bridge"}`
+	if string(calls[0].Params.NetworkConfig) != want || calls[0].Params.IfName != "net1" {
+		t.Fatalf("Unexpected cni parameters: %+v, want config %s", calls[0].Params, want)
+	}
+}
+
+func TestMissingNetwork(t *testing.T) {
+	dynamicClient := newNetworkClient()
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.DynamicClient = dynamicClient
+	})
+
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	h.expectCalls()
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		green := statuses["green"]
+		return green.State == "Failed" && green.LastError == "network default/green not found"
+	})
+	// the syncs of the Pod don't report the missing network again
+	h.annotatePod("vnf", `[{"name":"green"}]`)
+	h.expectCalls()
+	events, err := h.client.CoreV1().Events(testNamespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list events: %v", err)
+	}
+	var count int32
+	for _, event := range events.Items {
+		if event.Reason == "NetworkNotFound" {
+			count += event.Count
+		}
+	}
+	if count != 1 {
+		t.Fatalf("Unexpected %d NetworkNotFound events, want 1", count)
+	}
+
+	if _, err := dynamicClient.Resource(networkGVR).Namespace(testNamespace).Create(context.TODO(), newNetwork("green", nil), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create the Network: %v", err)
+	}
+	h.expectCalls("ADD vnf green")
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		green := statuses["green"]
+		return green.State == "Active" && green.LastError == ""
+	})
+}
+
+var networkGVR = schema.GroupVersionResource{Group: "kaloom.com", Version: "v1", Resource: "networks"}
+
+// newNetwork returns the kaloom Network name with the given annotations
+func newNetwork(name string, annotations map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kaloom.com/v1",
+		"kind":       "Network",
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   testNamespace,
+			"generation":  int64(1),
+			"annotations": annotations,
+		},
+	}}
+}
+
+// newNetworkClient returns a fake dynamic client serving networks
+func newNetworkClient(networks ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		networkGVR: "NetworkList",
+	}, networks...)
+}
+
+func TestReplugOnNetworkUpdate(t *testing.T) {
+	network := newNetwork("green", map[string]interface{}{"podagent.kaloom.com/replug-on-update": "true"})
+	dynamicClient := newNetworkClient(network)
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.DynamicClient = dynamicClient
+	})
+
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	h.expectCalls("ADD vnf green")
+
+	// the fake client doesn't bump the generation on a spec update
+	network.SetGeneration(2)
+	if _, err := dynamicClient.Resource(networkGVR).Namespace(testNamespace).Update(context.TODO(), network, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update the Network: %v", err)
+	}
+	h.expectCalls("DEL vnf green", "ADD vnf green")
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		return statuses["green"].State == "Active"
+	})
+}
+
+func TestDeletedNetworkKeepsAttachment(t *testing.T) {
+	dynamicClient := newNetworkClient(newNetwork("green", nil))
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.DynamicClient = dynamicClient
+	})
+
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	h.expectCalls("ADD vnf green")
+
+	// the Network didn't opt in for detach-on-delete, its plugged network
+	// attachment is neither detached nor reported as failed
+	if err := dynamicClient.Resource(networkGVR).Namespace(testNamespace).Delete(context.TODO(), "green", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete the Network: %v", err)
+	}
+	h.expectCalls()
+	h.annotatePod("vnf", `[{"name":"green","args":{"VLAN":"100"}}]`)
+	h.expectCalls()
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		return statuses["green"].State == "Active" && statuses["green"].LastError == ""
+	})
+}
+
+func TestDetachOnNetworkDelete(t *testing.T) {
+	dynamicClient := newNetworkClient(
+		newNetwork("green", map[string]interface{}{"podagent.kaloom.com/detach-on-delete": "true"}),
+		newNetwork("red", nil))
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.DynamicClient = dynamicClient
+	})
+
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	h.expectCalls("ADD vnf green")
+
+	// the worker is held by a slow network attachment while the Network
+	// get deleted then the Pod synced, the pending detach isn't overridden
+	h.faults.SetFault("red", fake.Fault{Ops: []fake.Op{fake.Add}, DelayRate: 1, Delay: 2 * time.Second})
+	h.createPod("slow", "c2", "s2", `[{"name":"red"}]`)
+	time.Sleep(testSettle)
+	if err := dynamicClient.Resource(networkGVR).Namespace(testNamespace).Delete(context.TODO(), "green", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete the Network: %v", err)
+	}
+	time.Sleep(testSettle)
+	h.annotatePod("vnf", `[{"name":"green"}]`)
+	h.expectCalls("ADD slow red", "DEL vnf green")
+}
+
+func TestInterfaceReusedAfterDelete(t *testing.T) {
+	h := newHarness(t)
+
+	h.createPod("vnf", "c1", "s1", `[{"name":"green","interface":"net1"}]`)
+	h.expectCalls("ADD vnf green")
+
+	// red takes over net1 while the delete of green is retried, its add
+	// waits for net1 to be released
+	h.faults.SetFault("green", fake.Fault{Ops: []fake.Op{fake.Del}, FailRate: 1})
+	h.annotatePod("vnf", `[{"name":"red","interface":"net1"}]`)
+	h.expectCalls()
+	h.faults.ClearFaults()
+	h.expectCalls("DEL vnf green", "ADD vnf red")
+}
+
+func TestSameNamePodsInNamespaces(t *testing.T) {
+	h := newHarness(t)
+
+	// the Pods of a StatefulSet deployed in two namespaces
+	h.createPod("db-0", "c1", "s1", `[{"name":"green"}]`)
+	h.expectCalls("ADD db-0 green")
+	h.namespace = "other"
+	h.createPod("db-0", "c2", "s2", `[{"name":"green"}]`)
+	h.expectCalls("ADD db-0 green")
+
+	h.deletePod("db-0")
+	calls := h.expectCalls("DEL db-0 green")
+	if calls[0].Params.Namespace != "other" || calls[0].Params.SandboxID != "s2" {
+		t.Fatalf("Unexpected cni parameters of the deleted pod: %+v", calls[0].Params)
+	}
+	h.namespace = testNamespace
+	h.deletePod("db-0")
+	calls = h.expectCalls("DEL db-0 green")
+	if calls[0].Params.Namespace != testNamespace || calls[0].Params.SandboxID != "s1" {
+		t.Fatalf("Unexpected cni parameters of the deleted pod: %+v", calls[0].Params)
+	}
+}
+
+func TestNetworksReadinessGate(t *testing.T) {
+	h := newHarness(t)
+
+	h.client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*apiv1.Pod)
+		pod.Spec.ReadinessGates = []apiv1.PodReadinessGate{{ConditionType: networksReadyCondition}}
+		return false, nil, nil
+	})
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"},{"name":"red"}]`)
+	h.expectCalls("ADD vnf green", "ADD vnf red")
+
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, testTimeout, true, func(context.Context) (bool, error) {
+		pod, err := h.client.CoreV1().Pods(h.namespace).Get(context.TODO(), "vnf", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == networksReadyCondition {
+				return cond.Status == apiv1.ConditionTrue, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("The %s condition isn't True: %v", networksReadyCondition, err)
+	}
+}
+
+// attachmentStatus an entry of the networks status annotation
+type attachmentStatus struct {
+	State         string `json:"state"`
+	LastOperation string `json:"lastOperation"`
+	LastError     string `json:"lastError"`
+	Retries       int    `json:"retries"`
+}
+
+// waitNetworksStatus waits for the networks status annotation of the Pod
+// name to satisfy cond
+func (h *harness) waitNetworksStatus(name string, cond func(map[string]attachmentStatus) bool) map[string]attachmentStatus {
+	h.t.Helper()
+	var statuses map[string]attachmentStatus
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, testTimeout, true, func(context.Context) (bool, error) {
+		pod, err := h.client.CoreV1().Pods(h.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		statuses = nil
+		if value, ok := pod.Annotations["podagent.kaloom.com/networks-status"]; ok {
+			if err := json.Unmarshal([]byte(value), &statuses); err != nil {
+				return false, err
+			}
+		}
+		return cond(statuses), nil
+	})
+	if err != nil {
+		h.t.Fatalf("Unexpected networks status of pod %s: %+v: %v", name, statuses, err)
+	}
+	return statuses
+}
+
+func TestNetworksStatusAnnotation(t *testing.T) {
+	h := newHarness(t)
+
+	h.faults.SetFault("red", fake.Fault{FailRate: 1, Err: &cnitypes.Error{Code: cnitypes.ErrInvalidNetworkConfig, Msg: "invalid"}})
+	h.faults.SetFault("blue", fake.Fault{FailRate: 1})
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"},{"name":"red"},{"name":"blue"}]`)
+	h.expectCalls("ADD vnf green")
+
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		green, red, blue := statuses["green"], statuses["red"], statuses["blue"]
+		return green.State == "Active" && green.LastOperation == "Add" && green.LastError == "" &&
+			red.State == "Failed" && red.LastError != "" &&
+			blue.State == "Dirty" && blue.LastError != "" && blue.Retries >= 1
+	})
+
+	// a transient failure get retried until it succeeds
+	h.faults.ClearFaults()
+	h.expectCalls("DEL vnf blue", "ADD vnf blue")
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		blue := statuses["blue"]
+		return blue.State == "Active" && blue.LastError == ""
+	})
+
+	// the removed networks are dropped off the annotation
+	h.annotatePod("vnf", `[{"name":"green"},{"name":"red"}]`)
+	h.expectCalls("DEL vnf blue")
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		_, ok := statuses["blue"]
+		return len(statuses) == 2 && !ok && statuses["red"].State == "Failed"
+	})
+}
+
+func TestTransientFailureEvent(t *testing.T) {
+	h := newHarness(t)
+
+	h.faults.SetFault("blue", fake.Fault{FailRate: 1, Err: &cni.PluginError{
+		Err:    &cnitypes.Error{Code: cnitypes.ErrTryAgainLater, Msg: "ipam unavailable"},
+		Output: "fake-ipam: connection refused",
+	}})
+	h.createPod("vnf", "c1", "s1", `[{"name":"blue"}]`)
+	// the transient failures get reported along with the cni-plugin output
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, testTimeout, true, func(context.Context) (bool, error) {
+		events, err := h.client.CoreV1().Events(testNamespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, event := range events.Items {
+			if event.Reason == "NetworkAttachmentRetrying" && event.Type == apiv1.EventTypeWarning &&
+				strings.Contains(event.Message, "fake-ipam: connection refused") {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("No NetworkAttachmentRetrying event with the cni-plugin output: %v", err)
+	}
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		return statuses["blue"].State == "Dirty"
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	h := newHarness(t)
+	server := httptest.NewServer(h.ctrl.MetricsHandler())
+	defer server.Close()
+
+	h.faults.SetFault("red", fake.Fault{FailRate: 1, Err: &cnitypes.Error{Code: cnitypes.ErrInvalidNetworkConfig, Msg: "invalid"}})
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"},{"name":"red"}]`)
+	h.expectCalls("ADD vnf green")
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		return statuses["green"].State == "Active" && statuses["red"].State == "Failed"
+	})
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to scrape the metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read the metrics: %v", err)
+	}
+	for _, want := range []string{
+		`podagent_network_attachments{state="Active"} 1`,
+		`podagent_network_attachments{state="Failed"} 1`,
+		`podagent_network_operations_total{operation="add",result="success"} 1`,
+		`podagent_network_operations_total{operation="add",result="permanent_failure"} 1`,
+		`podagent_event_queue_length 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Missing metric %s in:\n%s", want, body)
+		}
+	}
+}
+
+func TestManagedPodsSelection(t *testing.T) {
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.Namespaces = []string{testNamespace, "other"}
+	})
+
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	h.expectCalls("ADD vnf green")
+
+	// the Pods of the other namespaces aren't managed
+	h.namespace = "unmanaged"
+	h.createPod("vnf", "c2", "s2", `[{"name":"green"}]`)
+	h.expectCalls()
+
+	h.namespace = "other"
+	h.createPod("vnf", "c3", "s3", `[{"name":"red"}]`)
+	calls := h.expectCalls("ADD vnf red")
+	if calls[0].Params.Namespace != "other" {
+		t.Fatalf("Unexpected namespace %q, want other", calls[0].Params.Namespace)
+	}
+}
+
+func TestInvalidPodSelection(t *testing.T) {
+	for _, opts := range []controller.Options{
+		{PodLabelSelector: "podagent.kaloom.com/managed in (true"},
+		{Namespaces: []string{"default"}, ExcludedNamespaces: []string{"default"}},
+	} {
+		opts.Runtime = fakeruntime.NewFakeRuntime()
+		opts.CNIPlugin = fake.NewRecorder()
+		if _, err := controller.NewController(opts); err == nil {
+			t.Errorf("Expected an error for the pod selection %+v", opts)
+		}
+	}
+}
+
+func TestDisabledRuntime(t *testing.T) {
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.Runtime = nil
+		opts.ContainerType = controller.Docker
+	})
+
+	// the controller runs but the network attachments fail
+	h.createPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		return statuses["green"].State == "Failed"
+	})
+	h.expectCalls()
+}
+
+// kubeletStandIn serves the kubelet's /pods endpoint off pods
+type kubeletStandIn struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	pods  map[string]*apiv1.Pod
+	token string
+	// down if set, the requests fail like when the kubelet is restarting
+	down bool
+}
+
+func newKubeletStandIn(t *testing.T, token string) *kubeletStandIn {
+	k := &kubeletStandIn{pods: make(map[string]*apiv1.Pod), token: token}
+	k.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		switch {
+		case r.URL.Path != "/pods":
+			http.NotFound(w, r)
+		case r.Header.Get("Authorization") != "Bearer "+k.token:
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		case k.down:
+			http.Error(w, "kubelet is down", http.StatusServiceUnavailable)
+		default:
+			pods := apiv1.PodList{}
+			for _, pod := range k.pods {
+				pods.Items = append(pods.Items, *pod)
+			}
+			_ = json.NewEncoder(w).Encode(pods)
+		}
+	}))
+	t.Cleanup(k.Close)
+	return k
+}
+
+func (k *kubeletStandIn) setPod(pod *apiv1.Pod) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pods[pod.Name] = pod
+}
+
+func (k *kubeletStandIn) deletePod(name string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.pods, name)
+}
+
+func (k *kubeletStandIn) setDown(down bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.down = down
+}
+
+func TestKubeletPodSource(t *testing.T) {
+	kubelet := newKubeletStandIn(t, "secret")
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the token: %v", err)
+	}
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.Kubelet = controller.KubeletOptions{
+			URL:        kubelet.URL,
+			PollPeriod: 10 * time.Millisecond,
+			TokenFile:  tokenFile,
+		}
+	})
+
+	// a static Pod, it's unknown to the apiserver
+	pod := h.newPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	kubelet.setPod(pod)
+	h.expectCalls("ADD vnf green")
+
+	pod = pod.DeepCopy()
+	pod.Annotations["networks"] = `[{"name":"green"},{"name":"red"}]`
+	kubelet.setPod(pod)
+	h.expectCalls("ADD vnf red")
+
+	// the Pods aren't deleted while the kubelet is unavailable
+	kubelet.setDown(true)
+	h.expectCalls()
+	kubelet.setDown(false)
+	h.expectCalls()
+
+	pod = pod.DeepCopy()
+	pod.Annotations["networks"] = `[{"name":"green"}]`
+	kubelet.setPod(pod)
+	h.expectCalls("DEL vnf red")
+
+	// the non running Pods aren't managed
+	pod = pod.DeepCopy()
+	pod.Status.Phase = apiv1.PodSucceeded
+	kubelet.setPod(pod)
+	h.expectCalls("DEL vnf green")
+
+	h.runtime.RemoveSandbox("s1")
+	kubelet.setPod(h.newPod("vnf", "c2", "s2", `[{"name":"blue"}]`))
+	h.expectCalls("ADD vnf blue")
+	kubelet.deletePod("vnf")
+	h.expectCalls("DEL vnf blue")
+}
+
+func TestDeselectedPod(t *testing.T) {
+	// the kubelet's Pods are selected off their labels by the podagent,
+	// unlike the apiserver's watch, the Pods are seen leaving the selection
+	kubelet := newKubeletStandIn(t, "secret")
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the token: %v", err)
+	}
+	h := newHarness(t, func(opts *controller.Options) {
+		opts.PodLabelSelector = "podagent.kaloom.com/managed=true"
+		// the Pods having records are synced on every resync
+		opts.ResyncPeriod = 50 * time.Millisecond
+		opts.Kubelet = controller.KubeletOptions{
+			URL:        kubelet.URL,
+			PollPeriod: 10 * time.Millisecond,
+			TokenFile:  tokenFile,
+		}
+	})
+
+	pod := h.newPod("vnf", "c1", "s1", `[{"name":"green"}]`)
+	pod.Labels = map[string]string{"podagent.kaloom.com/managed": "true"}
+	if _, err := h.client.CoreV1().Pods(h.namespace).Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create pod: %v", err)
+	}
+	kubelet.setPod(pod)
+	h.expectCalls("ADD vnf green")
+
+	// the label is removed off the running Pod, its networks are kept
+	pod = pod.DeepCopy()
+	pod.Labels = nil
+	if _, err := h.client.CoreV1().Pods(h.namespace).Update(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+	kubelet.setPod(pod)
+	h.expectCalls()
+
+	// the Pod is selected again, its network is still active
+	pod = pod.DeepCopy()
+	pod.Labels = map[string]string{"podagent.kaloom.com/managed": "true"}
+	if _, err := h.client.CoreV1().Pods(h.namespace).Update(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+	kubelet.setPod(pod)
+	h.expectCalls()
+	h.waitNetworksStatus("vnf", func(statuses map[string]attachmentStatus) bool {
+		return statuses["green"].State == "Active"
+	})
+
+	// the deleted Pod's networks are released on the next resync
+	h.deletePod("vnf")
+	kubelet.deletePod("vnf")
+	h.expectCalls("DEL vnf green")
+}
@@ -24,10 +24,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
 	pb "k8s.io/cri-api/pkg/apis/runtime/v1"
+	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/kubelet/util"
 )
 
@@ -38,6 +38,8 @@ const (
 // CrioRuntime runtime object
 type CrioRuntime struct {
 	client pb.RuntimeServiceClient
+	// requestTimeout the timeout of a request to crio
+	requestTimeout time.Duration
 }
 
 type PodStatusResponseInfo struct {
@@ -61,9 +63,9 @@ type NameSpaceInfo struct {
 // GetNetNS returns the network namespace of the given containerID. The ID
 // supplied is typically the ID of a pod sandbox. This getter doesn't try
 // to map non-sandbox IDs to their respective sandboxes.
-func (cr *CrioRuntime) GetNetNS(podSandboxID string) (string, error) {
+func (cr *CrioRuntime) GetNetNS(ctx context.Context, podSandboxID string) (string, error) {
 
-	glog.V(4).Infof("GetNetNS:podSandboxID:%s", podSandboxID)
+	klog.V(4).InfoS("GetNetNS", "sandbox", podSandboxID)
 	if podSandboxID == "" {
 		return "", fmt.Errorf("ID cannot be empty")
 	}
@@ -72,34 +74,36 @@ func (cr *CrioRuntime) GetNetNS(podSandboxID string) (string, error) {
 		PodSandboxId: podSandboxID,
 		Verbose:      true, // TODO see with non verbose if all info is there
 	}
-	glog.V(5).Infof("PodSandboxStatusRequest: %v", request)
-	r, err := cr.client.PodSandboxStatus(context.Background(), request)
-	glog.V(5).Infof("PodSandboxStatusResponse: %v", r)
+	klog.V(5).InfoS("PodSandboxStatusRequest", "request", request)
+	ctx, cancel := context.WithTimeout(ctx, cr.requestTimeout)
+	defer cancel()
+	r, err := cr.client.PodSandboxStatus(ctx, request)
+	klog.V(5).InfoS("PodSandboxStatusResponse", "response", r)
 	if err != nil {
 		return "", err
 	}
 
 	mapInfo := r.GetInfo()
-	glog.V(5).Infof("GetNetNS:GetInfo():%s", mapInfo)
+	klog.V(5).InfoS("GetNetNS: sandbox status info", "sandbox", podSandboxID, "info", mapInfo)
 	var podStatusResponseInfo PodStatusResponseInfo
 	info := mapInfo["info"]
-	glog.V(5).Infof("GetNetNS:info:%s", info)
 	err = json.Unmarshal([]byte(info), &podStatusResponseInfo)
 	if err != nil {
-		glog.Errorf("GetNetNS:error decoding response: %v", err)
+		kv := []interface{}{"sandbox", podSandboxID}
 		if e, ok := err.(*json.SyntaxError); ok {
-			glog.Errorf("GetNetNS:syntax error at byte offset %d", e.Offset)
+			kv = append(kv, "offset", e.Offset)
 		}
+		klog.ErrorS(err, "GetNetNS: error decoding response", kv...)
 		return "", err
 	}
 
 	namespaces := podStatusResponseInfo.RunTimeSpec.Linux.NameSpaces
-	glog.V(5).Infof("GetNetNS:RunTimeSpec.Linux.NameSpaces: %v", namespaces)
+	klog.V(5).InfoS("GetNetNS: runtime spec namespaces", "sandbox", podSandboxID, "namespaces", namespaces)
 	for _, namespace := range namespaces {
 		if namespace.Type == "network" {
 			ss := strings.Split(namespace.Path, "/")
 			netNS := ss[len(ss)-1]
-			glog.V(5).Infof("GetNetNS:NetNS:%s", netNS)
+			klog.V(5).InfoS("GetNetNS", "sandbox", podSandboxID, "netns", netNS)
 			return fmt.Sprintf(crioNetNSFmt, netNS), nil
 		}
 	}
@@ -107,8 +111,8 @@ func (cr *CrioRuntime) GetNetNS(podSandboxID string) (string, error) {
 }
 
 // GetSandboxID returns kubernete's crio sandbox container ID
-func (cr *CrioRuntime) GetSandboxID(containerID string) (string, error) {
-	glog.V(5).Infof("GetSandboxID:containerID:%s", containerID)
+func (cr *CrioRuntime) GetSandboxID(ctx context.Context, containerID string) (string, error) {
+	klog.V(5).InfoS("GetSandboxID", "container", containerID)
 	if containerID == "" {
 		return "", fmt.Errorf("ID cannot be empty")
 	}
@@ -121,9 +125,11 @@ func (cr *CrioRuntime) GetSandboxID(containerID string) (string, error) {
 		Filter: filter,
 	}
 
-	glog.V(5).Infof("ListContainerRequest: %v", request)
-	r, err := cr.client.ListContainers(context.Background(), request)
-	glog.V(5).Infof("ListContainerResponse: %v", r)
+	klog.V(5).InfoS("ListContainerRequest", "request", request)
+	ctx, cancel := context.WithTimeout(ctx, cr.requestTimeout)
+	defer cancel()
+	r, err := cr.client.ListContainers(ctx, request)
+	klog.V(5).InfoS("ListContainerResponse", "response", r)
 	if err != nil {
 		return "", err
 	}
@@ -136,10 +142,29 @@ func (cr *CrioRuntime) GetSandboxID(containerID string) (string, error) {
 	}
 
 	sandboxID := containerslist[0].PodSandboxId
-	glog.V(5).Infof("ContainerStatusResponse:SandboxId %s", sandboxID)
+	klog.V(5).InfoS("GetSandboxID", "container", containerID, "sandbox", sandboxID)
 	return sandboxID, nil
 }
 
+// ListSandboxIDs returns the IDs of all the crio pod sandboxes
+func (cr *CrioRuntime) ListSandboxIDs(ctx context.Context) ([]string, error) {
+	request := &pb.ListPodSandboxRequest{}
+	klog.V(5).InfoS("ListPodSandboxRequest", "request", request)
+	ctx, cancel := context.WithTimeout(ctx, cr.requestTimeout)
+	defer cancel()
+	r, err := cr.client.ListPodSandbox(ctx, request)
+	klog.V(5).InfoS("ListPodSandboxResponse", "response", r)
+	if err != nil {
+		return nil, err
+	}
+
+	sandboxIDs := make([]string, 0, len(r.GetItems()))
+	for _, sandbox := range r.GetItems() {
+		sandboxIDs = append(sandboxIDs, sandbox.Id)
+	}
+	return sandboxIDs, nil
+}
+
 func getConnection(endPoints []string, timeOut time.Duration) (*grpc.ClientConn, error) {
 	if endPoints == nil || len(endPoints) == 0 {
 		return nil, fmt.Errorf("endpoint is not set")
@@ -147,13 +172,13 @@ func getConnection(endPoints []string, timeOut time.Duration) (*grpc.ClientConn,
 	endPointsLen := len(endPoints)
 	var conn *grpc.ClientConn
 	for indx, endPoint := range endPoints {
-		glog.Infof("connect using endpoint '%s' with '%s' timeout", endPoint, timeOut)
+		klog.InfoS("Connecting to the runtime", "endpoint", endPoint, "timeout", timeOut)
 		addr, dialer, err := util.GetAddressAndDialer(endPoint)
 		if err != nil {
 			if indx == endPointsLen-1 {
 				return nil, err
 			}
-			glog.Error(err)
+			klog.ErrorS(err, "Invalid runtime endpoint", "endpoint", endPoint)
 			continue
 		}
 		conn, err = grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(timeOut), grpc.WithContextDialer(dialer))
@@ -162,16 +187,17 @@ func getConnection(endPoints []string, timeOut time.Duration) (*grpc.ClientConn,
 			if indx == endPointsLen-1 {
 				return nil, errMsg
 			}
-			glog.Error(errMsg)
+			klog.ErrorS(errMsg, "Failed to connect to the runtime", "endpoint", endPoint)
 		} else {
-			glog.Infof("connected successfully using endpoint: %s", endPoint)
+			klog.InfoS("Connected to the runtime", "endpoint", endPoint)
 			break
 		}
 	}
 	return conn, nil
 }
 
-// NewCrioRuntime instantiate a crio runtime object
+// NewCrioRuntime instantiate a crio runtime object, timeOut bounds both the
+// connection and every request to crio
 func NewCrioRuntime(endpoint string, timeOut time.Duration) (*CrioRuntime, error) {
 
 	if endpoint == "" {
@@ -184,7 +210,8 @@ func NewCrioRuntime(endpoint string, timeOut time.Duration) (*CrioRuntime, error
 	runtimeClient := pb.NewRuntimeServiceClient(clientConnection)
 
 	cr := &CrioRuntime{
-		client: runtimeClient,
+		client:         runtimeClient,
+		requestTimeout: timeOut,
 	}
 
 	return cr, nil
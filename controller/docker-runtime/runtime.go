@@ -18,11 +18,13 @@ limitations under the License.
 package dockerruntime
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/blang/semver"
 	dockertypes "github.com/docker/docker/api/types"
-	"github.com/golang/glog"
+	"github.com/docker/docker/api/types/filters"
+	"k8s.io/klog/v2"
 
 	"k8s.io/kubernetes/pkg/kubelet/util/cache"
 )
@@ -31,7 +33,8 @@ const (
 	dockerNetNSFmt = "/proc/%v/ns/net"
 )
 
-// DockerRuntime docker runtime object
+// DockerRuntime docker runtime object, its requests are bounded by the
+// libdocker client's own timeout rather than by their ctx
 type DockerRuntime struct {
 	client libdocker.Interface
 	// caches the version of the runtime.
@@ -52,19 +55,19 @@ func getNetworkNamespace(c *dockertypes.ContainerJSON) (string, error) {
 // GetNetNS returns the network namespace of the given containerID. The ID
 // supplied is typically the ID of a pod sandbox. This getter doesn't try
 // to map non-sandbox IDs to their respective sandboxes.
-func (dr *DockerRuntime) GetNetNS(podSandboxID string) (string, error) {
+func (dr *DockerRuntime) GetNetNS(ctx context.Context, podSandboxID string) (string, error) {
 	c, err := dr.client.InspectContainer(podSandboxID)
 	if err != nil {
 		return "", err
 	}
 
 	ns, err := getNetworkNamespace(c)
-	glog.V(5).Infof("GetNetNS:%s %v", ns, err)
+	klog.V(5).InfoS("GetNetNS", "sandbox", podSandboxID, "netns", ns, "err", err)
 	return ns, err
 }
 
 // GetSandboxID returns kubernete's docker "pause" container ID
-func (dr *DockerRuntime) GetSandboxID(containerID string) (string, error) {
+func (dr *DockerRuntime) GetSandboxID(ctx context.Context, containerID string) (string, error) {
 	const kubernetesSandboxID = "io.kubernetes.sandbox.id"
 	c, err := dr.client.InspectContainer(containerID)
 	if err != nil {
@@ -75,10 +78,25 @@ func (dr *DockerRuntime) GetSandboxID(containerID string) (string, error) {
 			return val, nil
 		}
 	}
-	glog.V(5).Infof("GetSandboxID:SandboxId %s", kubernetesSandboxID)
+	klog.V(5).InfoS("GetSandboxID: sandbox label not found", "container", containerID, "label", kubernetesSandboxID)
 	return "", fmt.Errorf("Cannot find label %s in container %q", kubernetesSandboxID, c.ID)
 }
 
+// ListSandboxIDs returns the IDs of all kubernete's docker "pause" containers
+func (dr *DockerRuntime) ListSandboxIDs(ctx context.Context) ([]string, error) {
+	const kubernetesContainerTypeLabel = "io.kubernetes.docker.type=podsandbox"
+	f := filters.NewArgs(filters.Arg("label", kubernetesContainerTypeLabel))
+	containers, err := dr.client.ListContainers(dockertypes.ContainerListOptions{All: true, Filters: f})
+	if err != nil {
+		return nil, err
+	}
+	sandboxIDs := make([]string, 0, len(containers))
+	for _, c := range containers {
+		sandboxIDs = append(sandboxIDs, c.ID)
+	}
+	return sandboxIDs, nil
+}
+
 // dockerVersion gets the version information from docker.
 func (dr *DockerRuntime) getDockerVersion() (*dockertypes.Version, error) {
 	v, err := dr.client.Version()
@@ -152,10 +170,9 @@ func NewDockerRuntime(client libdocker.Interface) (*DockerRuntime, error) {
 	}
 
 	if dockerInfo, err := dr.client.Info(); err != nil {
-		glog.Errorf("Failed to execute Info() call to the Docker client: %v", err)
+		klog.ErrorS(err, "Failed to execute Info() call to the Docker client")
 	} else {
-		glog.Infof("Docker client info: server version %s, is an experimental build? %v",
-			dockerInfo.ServerVersion, dockerInfo.ExperimentalBuild)
+		klog.InfoS("Docker client info", "serverVersion", dockerInfo.ServerVersion, "experimentalBuild", dockerInfo.ExperimentalBuild)
 	}
 
 	// check docker version compatibility.
@@ -0,0 +1,56 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isPermanentError returns true if retrying the operation that failed with
+// err can't succeed until the network attachment, its network config or the
+// cni-plugins get changed, i.e. the cni errors reporting a misconfiguration
+// and the cri errors reporting an invalid or unsupported request. The other
+// errors, including the cni "try again later" one, are transient
+func isPermanentError(err error) bool {
+	var cniErr *cnitypes.Error
+	if errors.As(err, &cniErr) {
+		switch cniErr.Code {
+		case cnitypes.ErrIncompatibleCNIVersion,
+			cnitypes.ErrUnsupportedField,
+			cnitypes.ErrInvalidEnvironmentVariables,
+			cnitypes.ErrDecodingFailure,
+			cnitypes.ErrInvalidNetworkConfig:
+			return true
+		}
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.InvalidArgument,
+			codes.PermissionDenied,
+			codes.Unauthenticated,
+			codes.Unimplemented:
+			return true
+		}
+	}
+	return false
+}
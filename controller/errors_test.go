@@ -0,0 +1,62 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsPermanentError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		permanent bool
+	}{
+		{err: errors.New("failed")},
+		{err: &cnitypes.Error{Code: cnitypes.ErrIncompatibleCNIVersion}, permanent: true},
+		{err: &cnitypes.Error{Code: cnitypes.ErrUnsupportedField}, permanent: true},
+		{err: &cnitypes.Error{Code: cnitypes.ErrInvalidEnvironmentVariables}, permanent: true},
+		{err: &cnitypes.Error{Code: cnitypes.ErrDecodingFailure}, permanent: true},
+		{err: &cnitypes.Error{Code: cnitypes.ErrInvalidNetworkConfig}, permanent: true},
+		{err: &cnitypes.Error{Code: cnitypes.ErrUnknownContainer}},
+		{err: &cnitypes.Error{Code: cnitypes.ErrIOFailure}},
+		{err: &cnitypes.Error{Code: cnitypes.ErrTryAgainLater}},
+		{err: &cnitypes.Error{Code: cnitypes.ErrInternal}},
+		// a plugin specific error code
+		{err: &cnitypes.Error{Code: 100}},
+		// wrapped as by the worker
+		{err: fmt.Errorf("failed to add network: %w", &cnitypes.Error{Code: cnitypes.ErrInvalidNetworkConfig}), permanent: true},
+		{err: status.Error(codes.InvalidArgument, "invalid"), permanent: true},
+		{err: status.Error(codes.PermissionDenied, "denied"), permanent: true},
+		{err: status.Error(codes.Unauthenticated, "unauthenticated"), permanent: true},
+		{err: status.Error(codes.Unimplemented, "unimplemented"), permanent: true},
+		{err: status.Error(codes.Unavailable, "unavailable")},
+		{err: status.Error(codes.DeadlineExceeded, "deadline exceeded")},
+		{err: status.Error(codes.NotFound, "not found")},
+		{err: status.Error(codes.Internal, "internal")},
+	} {
+		if got := isPermanentError(tc.err); got != tc.permanent {
+			t.Errorf("%v: unexpected permanent %v", tc.err, got)
+		}
+	}
+}
@@ -20,8 +20,9 @@ import (
 	"container/list"
 	"fmt"
 	"sync"
+	"time"
 
-	"github.com/golang/glog"
+	"k8s.io/klog/v2"
 )
 
 // Event struct
@@ -35,11 +36,18 @@ type EventQueue struct {
 	m    map[string]*list.Element // ref in the eventQueue list
 	lock sync.Mutex
 	cond *sync.Cond
+	// retries the number of consecutive retries of an event keyed by event's key
+	retries map[string]int
+	// retryDelay the delay before the first retry of an event, doubled on
+	// every consecutive retry up to maxRetryDelay
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
 }
 
 // newQueue will create a new FIFO queue
 func newQueue() *EventQueue {
-	eq := &EventQueue{m: make(map[string]*list.Element), q: list.New()}
+	eq := &EventQueue{m: make(map[string]*list.Element), q: list.New(), retries: make(map[string]int),
+		retryDelay: retryDelay, maxRetryDelay: maxRetryDelay}
 	eq.q.Init()
 	eq.cond = sync.NewCond(&eq.lock)
 	return eq
@@ -57,13 +65,13 @@ func (eq *EventQueue) Enqueue(event *Event) {
 	defer eq.cond.L.Unlock()
 
 	key := event.getKey()
-	glog.V(5).Infof("Enqueuing using key:%s", key)
+	klog.V(5).InfoS("Enqueuing event", "key", key)
 	if _, ok := eq.m[key]; ok {
 		return
 	}
 
 	e := eq.q.PushBack(*event)
-	glog.V(5).Infof("Enqueue new event:", event)
+	klog.V(5).InfoS("Enqueued new event", "key", key, "event", event)
 	eq.m[key] = e
 	eq.cond.Signal()
 }
@@ -80,3 +88,55 @@ func (eq *EventQueue) Dequeue() *Event {
 	delete(eq.m, ev.getKey())
 	return &ev
 }
+
+// Len returns the number of events in the queue, the ones waiting for
+// their retry delay aren't
+func (eq *EventQueue) Len() int {
+	eq.cond.L.Lock()
+	defer eq.cond.L.Unlock()
+	return eq.q.Len()
+}
+
+// setRetryPolicy sets the delay before the first retry of an event and the
+// max delay between two retries
+func (eq *EventQueue) setRetryPolicy(delay, maxDelay time.Duration) {
+	eq.cond.L.Lock()
+	defer eq.cond.L.Unlock()
+	eq.retryDelay = delay
+	eq.maxRetryDelay = maxDelay
+}
+
+// Retry will push the event in the FIFO queue once a delay, doubled on every
+// consecutive retry of the event, has elapsed. The delay is returned
+func (eq *EventQueue) Retry(event *Event) time.Duration {
+	eq.cond.L.Lock()
+	key := event.getKey()
+	retries := eq.retries[key]
+	eq.retries[key] = retries + 1
+	retryDelay, maxRetryDelay := eq.retryDelay, eq.maxRetryDelay
+	eq.cond.L.Unlock()
+
+	delay := maxRetryDelay
+	if retries < 20 {
+		if d := retryDelay << uint(retries); d < maxRetryDelay {
+			delay = d
+		}
+	}
+	time.AfterFunc(delay, func() { eq.Enqueue(event) })
+	return delay
+}
+
+// Retrying returns true if the event failed and is to be retried, i.e. it
+// wasn't forgotten since its last Retry
+func (eq *EventQueue) Retrying(event *Event) bool {
+	eq.cond.L.Lock()
+	defer eq.cond.L.Unlock()
+	return eq.retries[event.getKey()] > 0
+}
+
+// Forget will reset the retries of the event
+func (eq *EventQueue) Forget(event *Event) {
+	eq.cond.L.Lock()
+	defer eq.cond.L.Unlock()
+	delete(eq.retries, event.getKey())
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakeruntime provides an in-memory container runtime, to exercise
+// the podagent without a cri
+package fakeruntime
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// FakeRuntime an in-memory container runtime keyed by container and
+// sandbox IDs
+type FakeRuntime struct {
+	mu sync.Mutex
+	// sandboxes the sandbox ID of the containers keyed by container ID
+	sandboxes map[string]string
+	// netns the netns path of the sandboxes keyed by sandbox ID
+	netns map[string]string
+}
+
+// NewFakeRuntime instantiate an empty fake runtime
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		sandboxes: make(map[string]string),
+		netns:     make(map[string]string),
+	}
+}
+
+// AddContainer adds the container containerID of the sandbox sandboxID
+// whose network namespace is netns, the sandbox is added if needed
+func (r *FakeRuntime) AddContainer(containerID, sandboxID, netns string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sandboxes[containerID] = sandboxID
+	r.netns[sandboxID] = netns
+}
+
+// RemoveSandbox removes the sandbox sandboxID and its containers
+func (r *FakeRuntime) RemoveSandbox(sandboxID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for containerID, id := range r.sandboxes {
+		if id == sandboxID {
+			delete(r.sandboxes, containerID)
+		}
+	}
+	delete(r.netns, sandboxID)
+}
+
+// GetNetNS returns the network namespace of the sandbox podSandboxID
+func (r *FakeRuntime) GetNetNS(ctx context.Context, podSandboxID string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	netns, ok := r.netns[podSandboxID]
+	if !ok {
+		return "", fmt.Errorf("sandbox %s not found", podSandboxID)
+	}
+	return netns, nil
+}
+
+// GetSandboxID returns the sandbox ID of the container containerID
+func (r *FakeRuntime) GetSandboxID(ctx context.Context, containerID string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if containerID == "" {
+		return "", fmt.Errorf("ID cannot be empty")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sandboxID, ok := r.sandboxes[containerID]
+	if !ok {
+		return "", fmt.Errorf("Didn't find any container with containerID:%s", containerID)
+	}
+	return sandboxID, nil
+}
+
+// ListSandboxIDs returns the IDs of all the sandboxes
+func (r *FakeRuntime) ListSandboxIDs(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sandboxIDs := make([]string, 0, len(r.netns))
+	for sandboxID := range r.netns {
+		sandboxIDs = append(sandboxIDs, sandboxID)
+	}
+	sort.Strings(sandboxIDs)
+	return sandboxIDs, nil
+}
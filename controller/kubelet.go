@@ -0,0 +1,256 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultKubeletPollPeriod the default period of the kubelet's Pods polling
+	defaultKubeletPollPeriod = 5 * time.Second
+	// kubeletRequestTimeout the timeout of a kubelet's Pods request
+	kubeletRequestTimeout = 30 * time.Second
+)
+
+// KubeletOptions the options of the kubelet's Pods source
+type KubeletOptions struct {
+	// URL the kubelet's URL, e.g. https://127.0.0.1:10250 for its
+	// authenticated endpoint or http://127.0.0.1:10255 for its read-only one
+	URL string
+	// PollPeriod the period of the Pods polling, defaults to 5s
+	PollPeriod time.Duration
+	// TokenFile the file of the bearer token authenticating to the kubelet,
+	// it's read on every poll so that a rotated token is picked up
+	TokenFile string
+	// CAFile the CA of the kubelet's serving certificate, the system's CAs
+	// are used if empty
+	CAFile string
+	// InsecureSkipVerify if set, the kubelet's serving certificate isn't
+	// verified (e.g. a self-signed one)
+	InsecureSkipVerify bool
+}
+
+// kubeletPodSource the Pods polled off the kubelet's /pods endpoint, unlike
+// the apiserver's watch, it keeps working when the control plane is
+// unavailable and it includes the static Pods
+type kubeletPodSource struct {
+	url          string
+	client       *http.Client
+	tokenFile    string
+	period       time.Duration
+	resyncPeriod time.Duration
+	selection    *podSelection
+	selector     labels.Selector
+	store        cache.Indexer
+	synced       atomic.Bool
+	// lastResync when the handler's UpdateFunc was last called for all the
+	// Pods
+	lastResync time.Time
+}
+
+var _ podSource = &kubeletPodSource{}
+
+// newKubeletPodSource returns the source of the running Pods of the
+// kubelet, selected by selection
+func newKubeletPodSource(opts KubeletOptions, selection *podSelection, resyncPeriod time.Duration) (*kubeletPodSource, error) {
+	selector, err := labels.Parse(selection.labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod label selector %q: %v", selection.labelSelector, err)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	if opts.CAFile != "" {
+		ca, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the kubelet's CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in the kubelet's CA file %s", opts.CAFile)
+		}
+	}
+	period := opts.PollPeriod
+	if period == 0 {
+		period = defaultKubeletPollPeriod
+	}
+	return &kubeletPodSource{
+		url: strings.TrimSuffix(opts.URL, "/") + "/pods",
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+			Timeout:   kubeletRequestTimeout,
+		},
+		tokenFile:    opts.TokenFile,
+		period:       period,
+		resyncPeriod: resyncPeriod,
+		selection:    selection,
+		selector:     selector,
+		store:        cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+	}, nil
+}
+
+func (s *kubeletPodSource) lister() corelisters.PodLister {
+	return corelisters.NewPodLister(s.store)
+}
+
+func (s *kubeletPodSource) hasSynced() bool {
+	return s.synced.Load()
+}
+
+func (s *kubeletPodSource) start(ctx context.Context, handler cache.ResourceEventHandler) error {
+	klog.InfoS("Polling the Pods off the kubelet", "url", s.url, "period", s.period)
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := s.poll(ctx, handler); err != nil {
+			// the cached Pods are kept as is until the kubelet is back
+			klog.ErrorS(err, "Failed to poll the kubelet's Pods", "url", s.url)
+		}
+	}, s.period)
+	return nil
+}
+
+// poll updates the cache off the kubelet's Pods and calls handler on the
+// added, updated and deleted Pods, as well as on every resync period
+func (s *kubeletPodSource) poll(ctx context.Context, handler cache.ResourceEventHandler) error {
+	pods, err := s.getPods(ctx)
+	if err != nil {
+		return err
+	}
+	initial := !s.synced.Load()
+	resync := s.resyncPeriod > 0 && time.Since(s.lastResync) >= s.resyncPeriod
+	if resync {
+		s.lastResync = time.Now()
+	}
+
+	seen := make(map[string]bool)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !s.selected(pod) {
+			continue
+		}
+		obj, err := stripPod(pod)
+		if err != nil {
+			return err
+		}
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			klog.ErrorS(err, "Failed to get key of kubelet's Pod")
+			continue
+		}
+		seen[key] = true
+		old, exists, err := s.store.GetByKey(key)
+		if err != nil {
+			return err
+		}
+		// the cache is updated ahead of calling handler, as an
+		// informer does
+		if err := s.store.Update(obj); err != nil {
+			return err
+		}
+		switch {
+		case !exists:
+			handler.OnAdd(obj, initial)
+		case resync || !reflect.DeepEqual(old, obj):
+			handler.OnUpdate(old, obj)
+		}
+	}
+	for _, key := range s.store.ListKeys() {
+		if seen[key] {
+			continue
+		}
+		old, exists, err := s.store.GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		if err := s.store.Delete(old); err != nil {
+			return err
+		}
+		handler.OnDelete(old)
+	}
+	s.synced.Store(true)
+	return nil
+}
+
+// selected returns true if pod is a managed running Pod, as selected by
+// the apiserver for the informer's source
+func (s *kubeletPodSource) selected(pod *apiv1.Pod) bool {
+	if pod.Status.Phase != apiv1.PodRunning {
+		return false
+	}
+	if !s.selector.Matches(labels.Set(pod.Labels)) {
+		return false
+	}
+	if len(s.selection.namespaces) > 0 {
+		for _, ns := range s.selection.namespaces {
+			if pod.Namespace == ns {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ns := range s.selection.excludedNamespaces {
+		if pod.Namespace == ns {
+			return false
+		}
+	}
+	return true
+}
+
+// getPods returns the kubelet's Pods
+func (s *kubeletPodSource) getPods(ctx context.Context) (*apiv1.PodList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.tokenFile != "" {
+		token, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the kubelet's token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("GET %s: %s: %s", s.url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	pods := &apiv1.PodList{}
+	if err := json.NewDecoder(resp.Body).Decode(pods); err != nil {
+		return nil, fmt.Errorf("failed to decode the kubelet's Pods: %w", err)
+	}
+	return pods, nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const metricsNamespace = "podagent"
+
+// metrics the Prometheus metrics of the controller, the network
+// attachments and the events queue are collected on scrape off the
+// ConfigStore and the EventQueue
+type metrics struct {
+	registry *prometheus.Registry
+	// operations the add and delete operations applied on the network
+	// attachments by result, i.e. success, transient or permanent failure
+	operations  *prometheus.CounterVec
+	attachments *prometheus.Desc
+	queueLength *prometheus.Desc
+	configStore *ConfigStore
+	eventQueue  *EventQueue
+}
+
+func newMetrics(configStore *ConfigStore, eventQueue *EventQueue) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "network_operations_total",
+			Help:      "Number of add and delete operations applied on the network attachments by result",
+		}, []string{"operation", "result"}),
+		attachments: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "network_attachments"),
+			"Number of network attachments by running state", []string{"state"}, nil),
+		queueLength: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "event_queue_length"),
+			"Number of events waiting to be processed", nil, nil),
+		configStore: configStore,
+		eventQueue:  eventQueue,
+	}
+	m.registry.MustRegister(m.operations, m,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}
+
+// observeOperation counts the operation op applied on a network attachment
+// that failed with err, if any
+func (m *metrics) observeOperation(op Optype, err error) {
+	result := "success"
+	switch {
+	case err == nil:
+	case isPermanentError(err):
+		result = "permanent_failure"
+	default:
+		result = "transient_failure"
+	}
+	m.operations.WithLabelValues(strings.ToLower(string(op)), result).Inc()
+}
+
+// Describe implements prometheus.Collector
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.attachments
+	ch <- m.queueLength
+}
+
+// Collect implements prometheus.Collector
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	cfgRecords, err := m.configStore.listConfigRecords()
+	if err != nil {
+		klog.ErrorS(err, "Failed to list the network attachments' records")
+	} else {
+		states := map[RunningState]int{Nil: 0, Active: 0, Dirty: 0, Failed: 0}
+		for _, cfgRecord := range cfgRecords {
+			states[cfgRecord.Running.State]++
+		}
+		for state, count := range states {
+			ch <- prometheus.MustNewConstMetric(m.attachments, prometheus.GaugeValue, float64(count), string(state))
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(m.queueLength, prometheus.GaugeValue, float64(m.eventQueue.Len()))
+}
+
+// MetricsHandler returns the handler serving the controller's metrics in
+// the Prometheus exposition format
+func (c *Controller) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(c.metrics.registry, promhttp.HandlerOpts{})
+}
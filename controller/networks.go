@@ -0,0 +1,460 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// multusNetworksAnnotation the Pod's annotation defined by the Kubernetes
+	// Network Custom Resource Definition De-facto Standard (i.e. multus)
+	multusNetworksAnnotation = "k8s.v1.cni.cncf.io/networks"
+
+	// replugOnUpdateAnnotation a kaloom Network's annotation, when "true"
+	// the network attachments get deleted then added back every time the
+	// Network's spec is updated
+	replugOnUpdateAnnotation = "podagent.kaloom.com/replug-on-update"
+	// detachOnDeleteAnnotation a kaloom Network's annotation, when "true"
+	// the network attachments get deleted once the Network is deleted
+	detachOnDeleteAnnotation = "podagent.kaloom.com/detach-on-delete"
+
+	// networkConfigTimeout the timeout of the get of a network resource
+	networkConfigTimeout = 30 * time.Second
+	// networksSyncTimeout the max wait of the Networks cache sync before
+	// the Pods are watched
+	networksSyncTimeout = 30 * time.Second
+)
+
+var (
+	kaloomNetworkGVR = schema.GroupVersionResource{Group: "kaloom.com", Version: "v1", Resource: "networks"}
+	nadGVR           = schema.GroupVersionResource{Group: "k8s.cni.cncf.io", Version: "v1", Resource: "network-attachment-definitions"}
+)
+
+// networkSelectionElement is an element of the multus networks annotation
+// when the latter is in its json list form
+type networkSelectionElement struct {
+	Name                string              `json:"name"`
+	Namespace           string              `json:"namespace,omitempty"`
+	MacRequest          string              `json:"mac,omitempty"`
+	InterfaceRequest    string              `json:"interface,omitempty"`
+	IPRequest           []string            `json:"ips,omitempty"`
+	BandwidthRequest    *cni.BandwidthEntry `json:"bandwidth,omitempty"`
+	PortMappingsRequest []cni.PortMapEntry  `json:"portMappings,omitempty"`
+}
+
+// parseNetworkSelectionElement parses an element of the multus networks
+// annotation in its string form i.e. [<namespace>/]<name>[@<interface>]
+func parseNetworkSelectionElement(element string) (*networkSelectionElement, error) {
+	e := &networkSelectionElement{}
+	name := element
+	if i := strings.Index(name, "/"); i >= 0 {
+		e.Namespace, name = name[:i], name[i+1:]
+		if e.Namespace == "" {
+			return nil, fmt.Errorf("invalid network selection element %q", element)
+		}
+	}
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name, e.InterfaceRequest = name[:i], name[i+1:]
+	}
+	e.Name = name
+	if e.Name == "" || strings.ContainsAny(e.Name, "/@") || strings.ContainsAny(e.Namespace, "@") ||
+		(strings.Contains(element, "@") && e.InterfaceRequest == "") {
+		return nil, fmt.Errorf("invalid network selection element %q", element)
+	}
+	return e, nil
+}
+
+// getMultusNetworks returns the networks off a multus networks annotation,
+// it's either a comma separated list of [<namespace>/]<name>[@<interface>]
+// or a json list of network selection elements
+func getMultusNetworks(networks string) (cniPodNetworks, error) {
+	elements := []networkSelectionElement{}
+	networks = strings.TrimSpace(networks)
+	if strings.HasPrefix(networks, "[") {
+		if err := json.Unmarshal([]byte(networks), &elements); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, element := range strings.Split(networks, ",") {
+			element = strings.TrimSpace(element)
+			if element == "" {
+				continue
+			}
+			e, err := parseNetworkSelectionElement(element)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, *e)
+		}
+	}
+
+	nets := cniPodNetworks{}
+	for _, e := range elements {
+		if e.Name == "" {
+			return nil, fmt.Errorf("network selection element without a name in %q", networks)
+		}
+		nets = append(nets, cniPodNetwork{
+			NetworkConfig: kc.NetworkConfig{
+				NetworkName: e.Name,
+				Namespace:   e.Namespace,
+				IfMAC:       e.MacRequest,
+			},
+			Interface:    e.InterfaceRequest,
+			IPs:          e.IPRequest,
+			Bandwidth:    e.BandwidthRequest,
+			PortMappings: e.PortMappingsRequest,
+			Kind:         cni.NetworkAttachmentDefinition,
+		})
+	}
+	return nets, nil
+}
+
+// resolveNetworkConfig fills cniParams's network config for the networks
+// that are invoked directly rather than through the default network: the
+// NetworkAttachmentDefinitions and, if directDelegate is set, the kaloom
+// Networks
+func (c *Controller) resolveNetworkConfig(ctx context.Context, cniParams *cni.Parameters) error {
+	var gvr schema.GroupVersionResource
+	var kind string
+	switch cniParams.NetworkKind {
+	case cni.NetworkAttachmentDefinition:
+		gvr, kind = nadGVR, "NetworkAttachmentDefinition"
+	case cni.KaloomNetwork:
+		if !c.directDelegate {
+			return nil
+		}
+		gvr, kind = kaloomNetworkGVR, "Network"
+	default:
+		return fmt.Errorf("unknown network kind %q", cniParams.NetworkKind)
+	}
+	namespace := cniParams.NetworkNamespace
+	if namespace == "" {
+		namespace = cniParams.Namespace
+	}
+	config, err := c.getNetworkResourceConfig(ctx, gvr, kind, namespace, cniParams.NetworkName)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to get network", "kind", kind, "network", klog.KRef(namespace, cniParams.NetworkName))
+		return err
+	}
+	cniParams.NetworkConfig = config
+	return nil
+}
+
+// getNetworkResourceConfig returns the cni config off the spec.config of
+// a network resource, like multus, the config's name is set to the network
+// resource's one if missing
+func (c *Controller) getNetworkResourceConfig(ctx context.Context, gvr schema.GroupVersionResource, kind, namespace, name string) ([]byte, error) {
+	if c.dynamicClient == nil {
+		return nil, fmt.Errorf("no client to get %s %s/%s", kind, namespace, name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, networkConfigTimeout)
+	defer cancel()
+	obj, err := c.dynamicClient.Resource(gvr).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	spec, _, err := unstructured.NestedString(obj.Object, "spec", "config")
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s %s/%s: %v", kind, namespace, name, err)
+	}
+	if strings.TrimSpace(spec) == "" {
+		return nil, fmt.Errorf("%s %s/%s has no config", kind, namespace, name)
+	}
+
+	config := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(spec), &config); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s %s/%s config: %v", kind, namespace, name, err)
+	}
+	if n, ok := config["name"].(string); ok && n != "" {
+		return []byte(spec), nil
+	}
+	config["name"] = name
+	return json.Marshal(config)
+}
+
+// newNetworkInformer creates the informer of the kaloom Networks, the
+// informer's cache is used to validate the networks before attaching
+// them and to retry the attachments once a missing network get created
+func (c *Controller) newNetworkInformer() {
+	c.networkInformerFactory = dynamicinformer.NewDynamicSharedInformerFactory(c.dynamicClient, c.resyncPeriod)
+	informer := c.networkInformerFactory.ForResource(kaloomNetworkGVR)
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.networkAdded,
+		UpdateFunc: c.networkUpdated,
+		DeleteFunc: c.networkDeleted,
+	})
+	c.networkLister = informer.Lister()
+	c.networksSynced = informer.Informer().HasSynced
+}
+
+// watchNetworks starts the informer of the kaloom Networks and waits up to
+// networksSyncTimeout for its cache to sync, so that the Pods get their
+// networks validated from the start. Until it does (e.g. the Network crd
+// is not installed) the networks are not validated
+func (c *Controller) watchNetworks(ctx context.Context) {
+	c.networkInformerFactory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, networksSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), c.networksSynced) {
+		klog.InfoS("Networks cache not synced, the networks are not validated until it does", "timeout", networksSyncTimeout)
+	}
+}
+
+// networkExists returns false only if the kaloom Network namespace/name is
+// known not to exist
+func (c *Controller) networkExists(namespace, name string) bool {
+	if c.networkLister == nil || !c.networksSynced() {
+		return true
+	}
+	_, err := c.networkLister.ByNamespace(namespace).Get(name)
+	return !apierrors.IsNotFound(err)
+}
+
+// validateNetwork returns an error if the network referred to by cniParams
+// is known not to exist
+func (c *Controller) validateNetwork(cniParams *cni.Parameters) error {
+	if cniParams.NetworkKind != cni.KaloomNetwork {
+		return nil
+	}
+	namespace := cniParams.NetworkNamespace
+	if namespace == "" {
+		namespace = cniParams.Namespace
+	}
+	if c.networkExists(namespace, cniParams.NetworkName) {
+		return nil
+	}
+	return getNetworkNotFoundError(cniParams)
+}
+
+// getNetworkNotFoundError returns the error of a network attachment whose
+// network doesn't exist, it's the reason of its Failed running config
+func getNetworkNotFoundError(cniParams *cni.Parameters) error {
+	namespace := cniParams.NetworkNamespace
+	if namespace == "" {
+		namespace = cniParams.Namespace
+	}
+	return fmt.Errorf("network %s/%s not found", namespace, cniParams.NetworkName)
+}
+
+// isNetworkNotFound returns true if running is the running config of a
+// network attachment that failed as its network doesn't exist
+func isNetworkNotFound(running RunningConfig, cniParams *cni.Parameters) bool {
+	return running.State == Failed && running.Reason == getNetworkNotFoundError(cniParams).Error()
+}
+
+// recordNetworkNotFound marks the network attachment of the record key
+// Failed, its network doesn't exist, and records an event on its Pod. It's
+// a no-op if the network attachment is already marked so
+func (c *Controller) recordNetworkNotFound(key string, running RunningConfig, cniParams *cni.Parameters) error {
+	if isNetworkNotFound(running, cniParams) {
+		return nil
+	}
+	err := getNetworkNotFoundError(cniParams)
+	running.State = Failed
+	running.Reason = err.Error()
+	if serr := c.configStore.saveRunningConfig(key, running); serr != nil {
+		return serr
+	}
+	klog.InfoS("Network not found, waiting for it to be created", "pod", klog.KRef(cniParams.Namespace, cniParams.PodName),
+		"network", getAttachmentName(cniParams.NetworkNamespace, cniParams.NetworkName))
+	c.recorder.Eventf(getPodReference(cniParams), apiv1.EventTypeWarning, "NetworkNotFound",
+		"%v, the network attachment will be retried once it get created", err)
+	return nil
+}
+
+func (c *Controller) networkAdded(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get key of added Network")
+		return
+	}
+	klog.V(5).InfoS("Network added", "network", key)
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	c.syncNetworkPods(namespace, name)
+}
+
+func (c *Controller) networkUpdated(oldObj, newObj interface{}) {
+	oldNetwork, err := meta.Accessor(oldObj)
+	if err != nil {
+		klog.ErrorS(err, "Failed to access updated Network")
+		return
+	}
+	newNetwork, err := meta.Accessor(newObj)
+	if err != nil {
+		klog.ErrorS(err, "Failed to access updated Network")
+		return
+	}
+	if oldNetwork.GetGeneration() == newNetwork.GetGeneration() &&
+		oldNetwork.GetAnnotations()[replugOnUpdateAnnotation] == newNetwork.GetAnnotations()[replugOnUpdateAnnotation] {
+		return
+	}
+	klog.V(5).InfoS("Network updated", "network", klog.KObj(newNetwork))
+	c.syncNetworkPods(newNetwork.GetNamespace(), newNetwork.GetName())
+}
+
+func (c *Controller) networkDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	network, err := meta.Accessor(obj)
+	if err != nil {
+		klog.ErrorS(err, "Failed to access deleted Network")
+		return
+	}
+	klog.V(5).InfoS("Network deleted", "network", klog.KObj(network))
+	if network.GetAnnotations()[detachOnDeleteAnnotation] != "true" {
+		return
+	}
+	c.detachNetworkPods(network.GetNamespace(), network.GetName())
+}
+
+// getNetworkGeneration returns the generation of the kaloom Network
+// referred to by cniParams, 0 if unknown
+func (c *Controller) getNetworkGeneration(cniParams *cni.Parameters) int64 {
+	network := c.getNetwork(cniParams)
+	if network == nil {
+		return 0
+	}
+	return network.GetGeneration()
+}
+
+// isNetworkUpdated returns true if the kaloom Network of a running config
+// opted in for re-plug on update and got updated since it was attached
+func (c *Controller) isNetworkUpdated(running interface{}) bool {
+	cniParams, err := getCNIParams(running)
+	if err != nil || cniParams.NetworkGeneration == 0 {
+		return false
+	}
+	network := c.getNetwork(cniParams)
+	if network == nil || network.GetAnnotations()[replugOnUpdateAnnotation] != "true" {
+		return false
+	}
+	return network.GetGeneration() != cniParams.NetworkGeneration
+}
+
+// isNetworkChanged returns true if the kaloom Network of a running config
+// got updated since it was attached
+func (c *Controller) isNetworkChanged(running interface{}) bool {
+	cniParams, err := getCNIParams(running)
+	if err != nil || cniParams.NetworkGeneration == 0 {
+		return false
+	}
+	network := c.getNetwork(cniParams)
+	return network != nil && network.GetGeneration() != cniParams.NetworkGeneration
+}
+
+// getNetwork returns the kaloom Network referred to by cniParams off the
+// informer's cache, nil if not found
+func (c *Controller) getNetwork(cniParams *cni.Parameters) metav1.Object {
+	if cniParams.NetworkKind != cni.KaloomNetwork || c.networkLister == nil || !c.networksSynced() {
+		return nil
+	}
+	namespace := cniParams.NetworkNamespace
+	if namespace == "" {
+		namespace = cniParams.Namespace
+	}
+	obj, err := c.networkLister.ByNamespace(namespace).Get(cniParams.NetworkName)
+	if err != nil {
+		return nil
+	}
+	network, err := meta.Accessor(obj)
+	if err != nil {
+		return nil
+	}
+	return network
+}
+
+// getNetworkPods returns the Pods referring to the kaloom Network
+// namespace/name along with the network attachment names
+func (c *Controller) getNetworkPods(namespace, name string) map[*apiv1.Pod]string {
+	networkPods := make(map[*apiv1.Pod]string)
+	// the Pods' lister is set once the Networks are watched, until the
+	// Pods' cache is synced their networks are validated as they get added
+	if !c.podsCacheSynced.Load() {
+		return networkPods
+	}
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "Failed to list Pods from the informer's cache")
+		return networkPods
+	}
+	for _, pod := range pods {
+		nets, err := getPodNetworks(pod)
+		if err != nil {
+			continue
+		}
+		for _, n := range nets {
+			networkNamespace := n.Namespace
+			if networkNamespace == "" {
+				networkNamespace = pod.Namespace
+			}
+			if n.Kind == cni.KaloomNetwork && n.NetworkName == name && networkNamespace == namespace {
+				networkPods[pod] = n.attachmentName(pod.Namespace)
+				break
+			}
+		}
+	}
+	return networkPods
+}
+
+// syncNetworkPods reconciles the Pods referring to the kaloom Network namespace/name
+func (c *Controller) syncNetworkPods(namespace, name string) {
+	for pod := range c.getNetworkPods(namespace, name) {
+		c.syncPod(pod.Namespace + "/" + pod.Name)
+	}
+}
+
+// detachNetworkPods deletes the network attachments of the Pods referring
+// to the kaloom Network namespace/name, the attachments are added back by
+// syncPod if the Network get created again
+func (c *Controller) detachNetworkPods(namespace, name string) {
+	for pod, networkName := range c.getNetworkPods(namespace, name) {
+		cfgRecords, err := c.getPodConfigRecords(pod.Namespace, pod.Name)
+		if err != nil {
+			klog.ErrorS(err, "Failed to get Pod's config records", "pod", klog.KObj(pod))
+			continue
+		}
+		cfgRecord, ok := cfgRecords[networkName]
+		if !ok || cfgRecord.Expected.Optype != Add {
+			continue
+		}
+		klog.V(3).InfoS("Network got deleted, detaching it from pod", "pod", klog.KObj(pod), "network", networkName, "kaloomNetwork", klog.KRef(namespace, name))
+		if err := c.delNetwork(pod.Namespace, pod.Name, networkName, cfgRecord); err != nil {
+			klog.ErrorS(err, "Failed to delete network", "pod", klog.KObj(pod), "network", networkName)
+		}
+	}
+}
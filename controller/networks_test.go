@@ -0,0 +1,95 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+)
+
+func TestParseNetworkSelectionElement(t *testing.T) {
+	for _, tc := range []struct {
+		element string
+		want    *networkSelectionElement
+	}{
+		{element: "green", want: &networkSelectionElement{Name: "green"}},
+		{element: "other/green", want: &networkSelectionElement{Name: "green", Namespace: "other"}},
+		{element: "green@net1", want: &networkSelectionElement{Name: "green", InterfaceRequest: "net1"}},
+		{element: "other/green@net1", want: &networkSelectionElement{Name: "green", Namespace: "other", InterfaceRequest: "net1"}},
+		{element: ""},
+		{element: "/green"},
+		{element: "other/"},
+		{element: "green@"},
+		{element: "@net1"},
+		{element: "a/b/green"},
+		{element: "other@x/green"},
+	} {
+		got, err := parseNetworkSelectionElement(tc.element)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tc.element, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: unexpected %+v, %v, want %+v", tc.element, got, err, tc.want)
+		}
+	}
+}
+
+func TestGetMultusNetworks(t *testing.T) {
+	green := cniPodNetwork{NetworkConfig: kc.NetworkConfig{NetworkName: "green"}, Kind: cni.NetworkAttachmentDefinition}
+	red := cniPodNetwork{NetworkConfig: kc.NetworkConfig{NetworkName: "red", Namespace: "other"}, Interface: "net1", Kind: cni.NetworkAttachmentDefinition}
+	for _, tc := range []struct {
+		networks string
+		want     cniPodNetworks
+		invalid  bool
+	}{
+		{networks: "", want: cniPodNetworks{}},
+		{networks: "green", want: cniPodNetworks{green}},
+		{networks: " green , other/red@net1,", want: cniPodNetworks{green, red}},
+		{networks: `[{"name":"green"},{"name":"red","namespace":"other","interface":"net1"}]`, want: cniPodNetworks{green, red}},
+		{
+			networks: ` [{"name":"green","mac":"02:00:00:00:00:01","ips":["10.0.0.1/24"],"portMappings":[{"hostPort":8080,"containerPort":80}]}]`,
+			want: cniPodNetworks{{
+				NetworkConfig: kc.NetworkConfig{NetworkName: "green", IfMAC: "02:00:00:00:00:01"},
+				IPs:           []string{"10.0.0.1/24"},
+				PortMappings:  []cni.PortMapEntry{{HostPort: 8080, ContainerPort: 80}},
+				Kind:          cni.NetworkAttachmentDefinition,
+			}},
+		},
+		{networks: "green,/red", invalid: true},
+		{networks: `[{"namespace":"other"}]`, invalid: true},
+		{networks: `[{"name":"green"}`, invalid: true},
+		{networks: `[{"name":1}]`, invalid: true},
+	} {
+		got, err := getMultusNetworks(tc.networks)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tc.networks, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: unexpected %+v, %v, want %+v", tc.networks, got, err, tc.want)
+		}
+	}
+}
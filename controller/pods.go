@@ -19,182 +19,458 @@ package controller
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"reflect"
 	"strings"
 	"time"
+	"unicode"
 
 	kc "github.com/kaloom/kubernetes-common"
-	"github.com/kaloom/kubernetes-common/gset"
 
 	"github.com/kaloom/kubernetes-podagent/controller/cni"
 
-	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	apiv1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
 )
 
 type cniPodNetwork struct {
 	kc.NetworkConfig
+	// Interface the network device name in the Pod, optional, if not
+	// specified it's derived off the network name (see kc.GetNetworkIfname)
+	Interface string `json:"interface,omitempty"`
+	// IPs the requested ip addresses (i.e. the "ips" capability), optional
+	IPs []string `json:"ips,omitempty"`
+	// Bandwidth the requested bandwidth limits, optional
+	Bandwidth *cni.BandwidthEntry `json:"bandwidth,omitempty"`
+	// PortMappings the requested port mappings, optional
+	PortMappings []cni.PortMapEntry `json:"portMappings,omitempty"`
+	// Args extra cni args passed to the cni-plugins (i.e. in CNI_ARGS), optional
+	Args map[string]string `json:"args,omitempty"`
+	// Kind the kind of the network resource, it depends on the annotation
+	// in which the network is listed
+	Kind cni.NetworkKind `json:"-"`
 }
 
-func (c *cniPodNetwork) ToProperty() cniPodNetworkProperty {
-	return cniPodNetworkProperty{
-		IfMAC:        c.IfMAC,
-		IsPrimary:    c.IsPrimary,
-		PodagentSkip: c.PodagentSkip,
+// attachmentName returns the name identifying the network attachment among
+// the Pod's ones, it's the network name qualified by its namespace when the
+// latter is not the Pod's one
+func (c *cniPodNetwork) attachmentName(podNamespace string) string {
+	return getAttachmentName(getNetworkNamespace(c.Namespace, podNamespace), c.NetworkName)
+}
+
+func getNetworkNamespace(networkNamespace, podNamespace string) string {
+	if networkNamespace == podNamespace {
+		return ""
 	}
+	return networkNamespace
 }
 
-type cniPodNetworkProperty struct {
-	IfMAC     string
-	IsPrimary bool
-	// PodagentSkip makes podagent skip configuring this network
-	PodagentSkip bool
+func getAttachmentName(networkNamespace, networkName string) string {
+	if networkNamespace == "" {
+		return networkName
+	}
+	return networkNamespace + "/" + networkName
 }
 
 type cniPodNetworks []cniPodNetwork
 
 const (
-	maxRetries = 60
-	retryDelay = 10 * time.Second
+	// networksAnnotation the Pod's annotation handled by kactus
+	networksAnnotation = "networks"
+)
+
+const (
+	// maxInterfaceNameLength the max length of a network device name on Linux (i.e. IFNAMSIZ-1)
+	maxInterfaceNameLength = 15
+
+	// leakedNetworkMinAge the minimum age of a libcni's cache entry before
+	// it's considered leaked when its sandbox doesn't exist
+	leakedNetworkMinAge = 10 * time.Minute
+
+	// podGetTimeout the timeout of the get of a Pod missing from the cache
+	podGetTimeout = 30 * time.Second
+)
+
+// reservedArgs the cni args set by the podagent, they can't be overridden
+// off the network annotation (nor can any K8S_ prefixed one)
+var reservedArgs = map[string]bool{
+	"IgnoreUnknown": true,
+}
+
+const (
+	// retryDelay the delay before retrying a network attachment that failed
+	// with a transient error, it's doubled on every consecutive failure up
+	// to maxRetryDelay
+	retryDelay    = time.Second
+	maxRetryDelay = 5 * time.Minute
 )
 
 // Process will take a element from the FIFO queue and attempt to process it (either add or remove network)
-func (c *Controller) Process(e *Event) {
+func (c *Controller) Process(ctx context.Context, e *Event) {
 	var err error
 
+	// the correlation ID of the operation, it tags the logs, the running
+	// config and the events of the network attachment
+	ctx = cni.WithOperationID(ctx, utilrand.String(8))
+	if ct, ok := e.data.(*checkTuple); ok {
+		ctx = c.withAttachmentLogger(ctx, &ct.AttachmentTuple)
+		c.processCheck(ctx, ct)
+		c.recordAttachmentStatus(&ct.AttachmentTuple, "", nil)
+		return
+	}
 	attachmentTuple := e.data.(*cni.AttachmentTuple)
-	key := c.configStore.getConfigRecordKey(attachmentTuple.PodName, attachmentTuple.NetworkName)
+	ctx = c.withAttachmentLogger(ctx, attachmentTuple)
+	logger := klog.FromContext(ctx)
+	// op the operation applied on the network attachment, if any
+	var op Optype
+	// released set once the network attachment's interface got deleted
+	var released bool
+	defer func() {
+		if op != "" {
+			c.metrics.observeOperation(op, err)
+		}
+		c.recordAttachmentStatus(attachmentTuple, op, err)
+	}()
+	key := c.configStore.getConfigRecordKey(attachmentTuple.Namespace, attachmentTuple.PodName, attachmentTuple.NetworkName)
 	cfgRecord, err := c.configStore.getConfigRecord(key)
 	if err != nil {
-		glog.V(3).Infof("network config record not found, ignoring event %+v ", e.data)
+		logger.V(3).Info("Network config record not found, ignoring event")
+		c.eventQueue.Forget(e)
 		return
 	}
+	// a Failed network attachment whose cni-plugins didn't get invoked
+	// has nothing to delete
+	notAdded := cfgRecord.Running.State == Nil ||
+		(cfgRecord.Running.State == Failed && cfgRecord.Running.Data == nil)
 
 	switch cfgRecord.Expected.Optype {
 	case Add:
-		if cfgRecord.Running.State == Nil {
-			err = c.applyAddNetwork(key, cfgRecord, e)
-			if err != nil {
-				c.eventQueue.Enqueue(&Event{data: e.data})
+		if cniParams, err := getCNIParams(cfgRecord.Expected.Data); err == nil && c.validateNetwork(cniParams) != nil {
+			// an added network attachment is left as is, it's plugged
+			// and only detached if its Network opted in for it (see
+			// detachNetworkPods)
+			if !notAdded {
+				logger.V(3).Info("Network not found, keeping the added network", "state", cfgRecord.Running.State)
+				c.eventQueue.Forget(e)
+				return
+			}
+			logger.V(3).Info("Network not found, dropping event until it get created")
+			if err := c.recordNetworkNotFound(key, cfgRecord.Running, cniParams); err != nil {
+				logger.Error(err, "Failed saving running config")
 			}
+			c.eventQueue.Forget(e)
 			return
 		}
-		if cfgRecord.Running.State == Dirty ||
-			!c.configStore.isConfigSame(cfgRecord.Expected, cfgRecord.Running) {
-			err = c.applyDeleteNetwork(key, cfgRecord, e)
-			if err != nil {
-				c.eventQueue.Enqueue(&Event{data: e.data})
-				return
+		switch {
+		case notAdded:
+			op = Add
+			err = c.applyAddNetwork(ctx, key, cfgRecord, e)
+		// an active network attachment whose network got updated is
+		// re-plugged, it's marked Dirty until it's added back
+		case cfgRecord.Running.State == Dirty || cfgRecord.Running.State == Failed ||
+			!isSameAttachment(cfgRecord.Expected.Data, cfgRecord.Running.Data) ||
+			c.isNetworkUpdated(cfgRecord.Running.Data):
+			op = Add
+			err = c.applyDeleteNetwork(ctx, key, cfgRecord, e)
+			if err == nil {
+				released = true
+				err = c.applyAddNetwork(ctx, key, cfgRecord, e)
 			}
-			err = c.applyAddNetwork(key, cfgRecord, e)
-			if err != nil {
-				c.eventQueue.Enqueue(&Event{data: e.data})
+		default:
+			logger.V(3).Info("Ignoring adding network as the same network is already running")
+		}
+	case Delete:
+		podGone, podDeselected := c.isPodGone(ctx, cfgRecord)
+		if notAdded {
+			logger.V(3).Info("Ignoring deleting network as it's not added")
+			if podGone {
+				c.configStore.delConfigRecord(key)
 			}
+			c.eventQueue.Forget(e)
 			return
 		}
-		glog.V(3).Infof("ignoring adding network as the same network is already running %+v", e.data)
-	case Delete:
-		if cfgRecord.Running.State == Nil {
-			glog.V(3).Infof("ignoring deleting network as it's not added %+v", e.data)
+		if podDeselected {
+			// it's checked again on the next resync, the network
+			// attachment is kept as is if the Pod is selected again
+			logger.V(4).Info("Pod is no longer managed, keeping its network")
+			c.eventQueue.Forget(e)
 			return
 		}
-		err = c.applyDeleteNetwork(key, cfgRecord, e)
-		if err != nil {
-			c.eventQueue.Enqueue(&Event{data: e.data})
+		op = Delete
+		err = c.applyDeleteNetwork(ctx, key, cfgRecord, e)
+		released = err == nil
+		if podGone {
+			// a best-effort delete to release the network attachment's
+			// resources (e.g. ipam), the record is removed anyway
+			if err != nil {
+				logger.Error(err, "Failed releasing network of deleted pod")
+			}
+			c.configStore.delConfigRecord(key)
+			c.eventQueue.Forget(e)
+			return
 		}
 	default:
-		glog.Errorf("processing invalid expected state in config record %+v in event %+v", cfgRecord, e)
+		logger.Error(nil, "Invalid expected state in config record", "optype", cfgRecord.Expected.Optype)
 	}
+	if err != nil {
+		c.handleError(ctx, key, e, err)
+	} else {
+		c.eventQueue.Forget(e)
+	}
+	if released {
+		// the adds of the Pod deferred until the interface got released
+		// get queued (see syncPod)
+		c.syncPod(attachmentTuple.Namespace + "/" + attachmentTuple.PodName)
+	}
+}
+
+// withOpLogger returns a context derived off ctx carrying a logger tagging
+// its logs with the operation op
+func withOpLogger(ctx context.Context, op interface{}) context.Context {
+	return klog.NewContext(ctx, klog.FromContext(ctx).WithValues("op", op))
 }
 
-func (c *Controller) applyDeleteNetwork(key string, cfgRecord ConfigRecord, e *Event) error {
+// withAttachmentLogger returns a context derived off ctx carrying a logger
+// (see klog.FromContext) tagging its logs with the pod and network keys of
+// the network attachment attachmentTuple
+func (c *Controller) withAttachmentLogger(ctx context.Context, attachmentTuple *cni.AttachmentTuple) context.Context {
+	podRef := klog.KRef(attachmentTuple.Namespace, attachmentTuple.PodName)
+	return klog.NewContext(ctx, klog.FromContext(ctx).WithValues("pod", podRef, "network", attachmentTuple.NetworkName))
+}
+
+// handleError retries the event e with backoff if err is transient,
+// otherwise the network attachment is marked Failed and the reason is
+// reported on its Pod, it's retried once the network attachment or its
+// network get changed (see addNetwork)
+func (c *Controller) handleError(ctx context.Context, key string, e *Event, err error) {
+	logger := klog.FromContext(ctx)
+	if ctx.Err() != nil {
+		// shutting down, the network attachment is Dirty and get checked
+		// on the next start
+		return
+	}
+	cfgRecord, gerr := c.configStore.getConfigRecord(key)
+	opID := cni.OperationID(ctx)
+	// the reason is the cni-plugins' error along with their output if any
+	reason := err
+	var pluginErr *cni.PluginError
+	if errors.As(err, &pluginErr) {
+		reason = pluginErr
+	}
+	if !isPermanentError(err) {
+		delay := c.eventQueue.Retry(e)
+		logger.V(3).Info("Retrying after transient error", "delay", delay, "err", err)
+		if gerr == nil {
+			c.recordAttachmentEvent(cfgRecord, "NetworkAttachmentRetrying", opID, reason)
+		}
+		return
+	}
+	c.eventQueue.Forget(e)
+
+	if gerr != nil {
+		logger.V(3).Info("Network config record not found, ignoring failure", "err", err)
+		return
+	}
+	cfgRecord.Running.State = Failed
+	cfgRecord.Running.Reason = reason.Error()
+	cfgRecord.Running.OperationID = opID
+	if serr := c.configStore.saveRunningConfig(key, cfgRecord.Running); serr != nil {
+		logger.Error(serr, "Failed saving running config")
+	}
+	logger.Error(err, "Network attachment failed permanently")
+	c.recordAttachmentEvent(cfgRecord, "NetworkAttachmentFailed", opID, reason)
+}
+
+// recordAttachmentEvent records a Warning Event on the Pod of a failed
+// network attachment, the Events are rate-limited by the recorder
+func (c *Controller) recordAttachmentEvent(cfgRecord ConfigRecord, eventReason, opID string, reason error) {
+	cniParams, err := getCNIParams(cfgRecord.Expected.Data)
+	if err != nil {
+		return
+	}
+	c.recorder.Eventf(getPodReference(cniParams), apiv1.EventTypeWarning, eventReason,
+		"failed to %s network %s (operation %s): %v", strings.ToLower(string(cfgRecord.Expected.Optype)),
+		getAttachmentName(cniParams.NetworkNamespace, cniParams.NetworkName), opID, reason)
+}
+
+func (c *Controller) applyDeleteNetwork(ctx context.Context, key string, cfgRecord ConfigRecord, e *Event) error {
+	ctx = withOpLogger(ctx, Delete)
+	logger := klog.FromContext(ctx)
+	opID := cni.OperationID(ctx)
 	cfgRecord.Running.State = Dirty
+	cfgRecord.Running.OperationID = opID
 	err := c.configStore.saveRunningConfig(key, cfgRecord.Running)
 	if err != nil {
-		glog.Errorf("Failed saving running config err:%v", err)
+		logger.Error(err, "Failed saving running config")
 		return err
 	}
 
-	err = c.cniPlugin.DeleteNetwork(getRunningCNIParams(cfgRecord.Running.Data))
+	cniParams, err := getCNIParams(cfgRecord.Running.Data)
 	if err != nil {
-		glog.Errorf("Failed deleting network %+v err:%v", e.data, err)
+		logger.Error(err, "Failed decoding running config")
+		return err
+	}
+	err = c.cniPlugin.DeleteNetwork(ctx, cniParams)
+	if err != nil {
+		logger.Error(err, "Failed deleting network", "sandbox", cniParams.SandboxID)
 		return fmt.Errorf("Failed to delete network %+v err:%w", e.data, err)
 	}
-	err = c.configStore.saveRunningConfig(key, RunningConfig{State: Nil})
+	err = c.configStore.saveRunningConfig(key, RunningConfig{State: Nil, OperationID: opID})
 	if err != nil {
-		glog.Errorf("Failed saving running config err:%v", err)
+		logger.Error(err, "Failed saving running config")
 		return err
 	}
-	glog.V(3).Infof("Succeeded deleting network %+v", e.data)
+	logger.V(3).Info("Succeeded deleting network", "sandbox", cniParams.SandboxID)
 	return nil
 }
 
-func (c *Controller) applyAddNetwork(key string, cfgRecord ConfigRecord, e *Event) error {
-	cfgRecord.Running.Data = cfgRecord.Expected.Data
+func (c *Controller) applyAddNetwork(ctx context.Context, key string, cfgRecord ConfigRecord, e *Event) error {
+	ctx = withOpLogger(ctx, Add)
+	logger := klog.FromContext(ctx)
+	opID := cni.OperationID(ctx)
+	cniParams, err := getCNIParams(cfgRecord.Expected.Data)
+	if err != nil {
+		logger.Error(err, "Failed decoding expected config")
+		return err
+	}
+	// the sandbox and its netns are resolved here rather than in the informer
+	// handlers so that a slow cri doesn't stall pod events delivery and the
+	// values are fresh when the cni-plugin get invoked
+	err = c.resolveSandbox(ctx, cniParams)
+	if err != nil {
+		return err
+	}
+	err = c.resolveNetworkConfig(ctx, cniParams)
+	if err != nil {
+		return err
+	}
+	cniParams.NetworkGeneration = c.getNetworkGeneration(cniParams)
+
+	cfgRecord.Running.Data = cniParams
 	cfgRecord.Running.State = Dirty
+	cfgRecord.Running.OperationID = opID
 	// Note: saveRunningConfig can fail if the pod is deleted in between,
 	// an error is returned to the caller, the caller(worker) requeue the event e again.
 	// worker while processing the event e in the next run removes the event permanently.
-	err := c.configStore.saveRunningConfig(key, cfgRecord.Running)
+	err = c.configStore.saveRunningConfig(key, cfgRecord.Running)
 	if err != nil {
-		glog.Errorf("Failed saving running config err:%v", err)
+		logger.Error(err, "Failed saving running config")
 		return err
 	}
 
-	err = c.cniPlugin.AddNetwork(getRunningCNIParams(cfgRecord.Running.Data))
+	err = c.cniPlugin.AddNetwork(ctx, cniParams)
 	if err != nil {
-		glog.Errorf("Failed adding network %+v err:%v", e.data, err)
+		logger.Error(err, "Failed adding network", "sandbox", cniParams.SandboxID)
 		return fmt.Errorf("Failed to add network %+v err:%w", e.data, err)
 	}
 
 	cfgRecord.Running.State = Active
-	c.configStore.saveRunningConfig(key, cfgRecord.Running)
+	err = c.configStore.saveRunningConfig(key, cfgRecord.Running)
 	if err != nil {
-		glog.Errorf("Failed saving running config err:%v", err)
+		logger.Error(err, "Failed saving running config")
 		return err
 	}
-	glog.V(3).Infof("Succeeded adding network %+v", e.data)
+	logger.V(3).Info("Succeeded adding network", "sandbox", cniParams.SandboxID)
 	return nil
 }
 
-func getNetworkSet(networks string) (gset.GSet, error) {
+func getNetworks(networks string) (cniPodNetworks, error) {
 	nets := cniPodNetworks{}
-	netSetBuilder := gset.NewBuilder()
-	err := json.Unmarshal([]byte(networks), &nets)
-	if err == nil {
-		for _, n := range nets {
-			np := n.ToProperty()
-			netSetBuilder.Add(n.NetworkName, np)
-		}
+	if err := json.Unmarshal([]byte(networks), &nets); err != nil {
+		return nil, err
 	}
-	return netSetBuilder.Result(), err
+	return nets, nil
 }
 
-func getNetworks(networks string) (cniPodNetworks, error) {
+// getPodNetworks returns the networks off both the kactus and the multus
+// networks annotations of a Pod
+func getPodNetworks(pod *apiv1.Pod) (cniPodNetworks, error) {
 	nets := cniPodNetworks{}
-	if err := json.Unmarshal([]byte(networks), &nets); err != nil {
-		return nil, err
+	if networks, ok := pod.Annotations[networksAnnotation]; ok {
+		n, err := getNetworks(networks)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", networksAnnotation, err)
+		}
+		nets = append(nets, n...)
+	}
+	if networks, ok := pod.Annotations[multusNetworksAnnotation]; ok {
+		n, err := getMultusNetworks(networks)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", multusNetworksAnnotation, err)
+		}
+		nets = append(nets, n...)
 	}
 	return nets, nil
 }
 
-func getRunningCNIParams(data interface{}) *cni.Parameters {
-	tdata := data.(map[string]interface{})
-	cniParams := &cni.Parameters{
-		Namespace:   tdata["Namespace"].(string),
-		PodName:     tdata["PodName"].(string),
-		SandboxID:   tdata["SandboxID"].(string),
-		NetnsPath:   tdata["NetnsPath"].(string),
-		NetworkName: tdata["NetworkName"].(string),
-		IfMAC:       tdata["IfMAC"].(string),
+// getCNIParams decodes the cni parameters off a config record data, the
+// data is either a *cni.Parameters or its json decoded form when the record
+// has been read back from the ConfigStore
+func getCNIParams(data interface{}) (*cni.Parameters, error) {
+	if cniParams, ok := data.(*cni.Parameters); ok {
+		return cniParams, nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	cniParams := &cni.Parameters{}
+	if err := json.Unmarshal(b, cniParams); err != nil {
+		return nil, err
+	}
+	return cniParams, nil
+}
+
+// isSameAttachment returns true if the expected and running config data
+// describe the same network attachment, the fields resolved by the worker
+// (i.e. container, sandbox, netns, network config and generation) are not
+// considered
+func isSameAttachment(expected, running interface{}) bool {
+	e, err := getCNIParams(expected)
+	if err != nil {
+		return false
+	}
+	r, err := getCNIParams(running)
+	if err != nil {
+		return false
+	}
+	ec, rc := *e, *r
+	ec.ContainerID, ec.SandboxID, ec.NetnsPath, ec.NetworkConfig, ec.NetworkGeneration = "", "", "", nil, 0
+	rc.ContainerID, rc.SandboxID, rc.NetnsPath, rc.NetworkConfig, rc.NetworkGeneration = "", "", "", nil, 0
+	// records saved by older podagent versions don't have the Pod's UID
+	if ec.PodUID == "" || rc.PodUID == "" {
+		ec.PodUID, rc.PodUID = "", ""
+	}
+	return reflect.DeepEqual(ec, rc)
+}
+
+// getPodReference returns a reference to the Pod of cniParams, used to
+// record events on it
+func getPodReference(cniParams *cni.Parameters) *apiv1.ObjectReference {
+	return &apiv1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  cniParams.Namespace,
+		Name:       cniParams.PodName,
+		UID:        types.UID(cniParams.PodUID),
 	}
-	return cniParams
 }
 
 func getContainerID(pod *apiv1.Pod) string {
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return ""
+	}
 	cidURI := pod.Status.ContainerStatuses[0].ContainerID
 	// format is docker://<cid>
 	parts := strings.Split(cidURI, "//")
@@ -204,251 +480,637 @@ func getContainerID(pod *apiv1.Pod) string {
 	return cidURI
 }
 
-func (c *Controller) getCNIAttachmentTuple(podName, networkName string) *cni.AttachmentTuple {
+func (c *Controller) getCNIAttachmentTuple(namespace, podName, networkName string) *cni.AttachmentTuple {
 	cniAttachmentTuple := &cni.AttachmentTuple{
+		Namespace:   namespace,
 		PodName:     podName,
 		NetworkName: networkName,
 	}
 	return cniAttachmentTuple
 }
 
-func (c *Controller) getCNIParams(podObj *apiv1.Pod, networkName string, np cniPodNetworkProperty) (*cni.Parameters, error) {
+// getIntentCNIParams returns the cni parameters of a network attachment as
+// expected by the Pod's annotation, the sandbox ID and netns path are left
+// empty, they get resolved by the worker off the container ID (see resolveSandbox)
+func getIntentCNIParams(podObj *apiv1.Pod, n cniPodNetwork) (*cni.Parameters, error) {
 	podName := podObj.ObjectMeta.Name
-	namespace := podObj.ObjectMeta.Namespace
-	if containerID := getContainerID(podObj); containerID != "" {
-		// the sandbox is the "pause" container
-		sandboxID, err := c.runtime.GetSandboxID(containerID)
-		if err != nil {
-			glog.Errorf("Failed to get Pod's %s sandbox ID from cri: %s", podName, err)
-			return nil, err
+	if err := validateCapabilityArgs(n); err != nil {
+		return nil, err
+	}
+	if err := validateArgs(n); err != nil {
+		return nil, err
+	}
+	containerID := getContainerID(podObj)
+	if containerID == "" {
+		return nil, fmt.Errorf("Failed to get Pod's %s container ID", podName)
+	}
+	cniParams := &cni.Parameters{
+		Namespace:        podObj.ObjectMeta.Namespace,
+		PodName:          podName,
+		PodUID:           string(podObj.ObjectMeta.UID),
+		ContainerID:      containerID,
+		NetworkName:      n.NetworkName,
+		NetworkNamespace: getNetworkNamespace(n.Namespace, podObj.ObjectMeta.Namespace),
+		NetworkKind:      n.Kind,
+		IfName:           n.Interface,
+		IfMAC:            n.IfMAC,
+		IPs:              n.IPs,
+		Bandwidth:        n.Bandwidth,
+		PortMappings:     n.PortMappings,
+	}
+	if len(n.Args) > 0 {
+		cniParams.Args = n.Args
+	}
+	return cniParams, nil
+}
+
+// validateArgs validates the extra cni args requested off a network
+// annotation entry, the keys set by the podagent are reserved and neither
+// keys nor values can hold the CNI_ARGS separators (i.e. ';' and '=')
+func validateArgs(n cniPodNetwork) error {
+	for k, v := range n.Args {
+		if k == "" {
+			return fmt.Errorf("network %s: empty cni arg name", n.NetworkName)
 		}
-		netns, err := c.runtime.GetNetNS(sandboxID)
-		if err != nil {
-			glog.Errorf("Failed to get netns of sandbox ID %s: %v", sandboxID, err)
-			return nil, err
+		if reservedArgs[k] || strings.HasPrefix(k, "K8S_") {
+			return fmt.Errorf("network %s: reserved cni arg %q", n.NetworkName, k)
 		}
-		cniParams := &cni.Parameters{
-			Namespace:   namespace,
-			PodName:     podName,
-			SandboxID:   sandboxID,
-			NetnsPath:   netns,
-			NetworkName: networkName,
-			IfMAC:       np.IfMAC,
+		if strings.ContainsAny(k, ";=") || strings.ContainsAny(v, ";=") {
+			return fmt.Errorf("network %s: cni arg %q=%q has an invalid character", n.NetworkName, k, v)
 		}
-		return cniParams, nil
 	}
-	return nil, fmt.Errorf("Failed to get Pod's %s container ID", podName)
+	return nil
 }
 
-func (c *Controller) addNetwork(podObj *apiv1.Pod, networkName string, np cniPodNetworkProperty) error {
-	// filter primary networks (i.e. in case we overwrite the default network attatchement on eth0)
-	if np.IsPrimary {
-		return nil
+// validateCapabilityArgs validates the runtime config capabilities
+// requested off a network annotation entry
+func validateCapabilityArgs(n cniPodNetwork) error {
+	for _, ip := range n.IPs {
+		if net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return fmt.Errorf("network %s: invalid ip %q", n.NetworkName, ip)
+			}
+		}
 	}
-	if np.PodagentSkip {
-		glog.V(3).Infof("Skipping adding pod's %s network %s", podObj.GetName(), networkName)
-		return nil
+	if n.IfMAC != "" {
+		if _, err := net.ParseMAC(n.IfMAC); err != nil {
+			return fmt.Errorf("network %s: invalid mac %q", n.NetworkName, n.IfMAC)
+		}
 	}
+	if b := n.Bandwidth; b != nil {
+		if b.IngressRate < 0 || b.IngressBurst < 0 || b.EgressRate < 0 || b.EgressBurst < 0 {
+			return fmt.Errorf("network %s: invalid negative bandwidth %+v", n.NetworkName, *b)
+		}
+	}
+	for i := range n.PortMappings {
+		pm := &n.PortMappings[i]
+		if pm.HostPort < 1 || pm.HostPort > 65535 || pm.ContainerPort < 1 || pm.ContainerPort > 65535 {
+			return fmt.Errorf("network %s: invalid port mapping %+v", n.NetworkName, *pm)
+		}
+		switch strings.ToLower(pm.Protocol) {
+		case "":
+			pm.Protocol = "tcp"
+		case "tcp", "udp", "sctp":
+			pm.Protocol = strings.ToLower(pm.Protocol)
+		default:
+			return fmt.Errorf("network %s: invalid port mapping protocol %q", n.NetworkName, pm.Protocol)
+		}
+		if pm.HostIP != "" && net.ParseIP(pm.HostIP) == nil {
+			return fmt.Errorf("network %s: invalid port mapping host ip %q", n.NetworkName, pm.HostIP)
+		}
+	}
+	return nil
+}
 
-	cniParams, err := c.getCNIParams(podObj, networkName, np)
+// resolveSandbox fills cniParams's sandbox ID and netns path off the cri
+func (c *Controller) resolveSandbox(ctx context.Context, cniParams *cni.Parameters) error {
+	// the docker runtime is disabled, the network attachments can't be added
+	if c.runtime == nil {
+		return status.Error(codes.Unimplemented, "no container runtime, please use crio")
+	}
+	// the sandbox is the "pause" container
+	sandboxID, err := c.runtime.GetSandboxID(ctx, cniParams.ContainerID)
 	if err != nil {
+		klog.ErrorS(err, "Failed to get Pod's sandbox ID from cri", "pod", klog.KRef(cniParams.Namespace, cniParams.PodName), "container", cniParams.ContainerID)
 		return err
 	}
-
-	key := c.configStore.getConfigRecordKey(podObj.GetName(), networkName)
-	err = c.configStore.saveExpectedConfig(key, ExpectedConfig{Optype: Add, Data: cniParams})
+	netns, err := c.runtime.GetNetNS(ctx, sandboxID)
 	if err != nil {
+		klog.ErrorS(err, "Failed to get netns of sandbox", "pod", klog.KRef(cniParams.Namespace, cniParams.PodName), "sandbox", sandboxID)
 		return err
 	}
-	c.eventQueue.Enqueue(&Event{data: c.getCNIAttachmentTuple(podObj.GetName(), networkName)})
-
+	cniParams.SandboxID = sandboxID
+	cniParams.NetnsPath = netns
 	return nil
 }
 
-func (c *Controller) delNetwork(podObj *apiv1.Pod, networkName string, np cniPodNetworkProperty) error {
+// addNetwork records the intent of attaching the network n to podObj and
+// queue an event for the worker unless cfgRecord, the Pod's existing record
+// for that network if any, shows the same attachment as already active
+func (c *Controller) addNetwork(podObj *apiv1.Pod, n cniPodNetwork, cfgRecord *ConfigRecord) error {
+	networkName := n.attachmentName(podObj.GetNamespace())
 	// filter primary networks (i.e. in case we overwrite the default network attatchement on eth0)
-	if np.IsPrimary {
+	if n.IsPrimary {
 		return nil
 	}
-	if np.PodagentSkip {
-		glog.V(3).Infof("Skipping deleting pod's %s network %s", podObj.GetName(), networkName)
+	if n.PodagentSkip {
+		klog.V(3).InfoS("Skipping adding network", "pod", klog.KObj(podObj), "network", networkName)
 		return nil
 	}
 
-	key := c.configStore.getConfigRecordKey(podObj.GetName(), networkName)
-	err := c.configStore.saveExpectedConfig(key, ExpectedConfig{Optype: Delete})
+	cniParams, err := getIntentCNIParams(podObj, n)
 	if err != nil {
 		return err
 	}
-	c.eventQueue.Enqueue(&Event{data: c.getCNIAttachmentTuple(podObj.GetName(), networkName)})
-	return nil
-}
 
-func (c *Controller) podAdded(podObj interface{}) {
-	pod := podObj.(*apiv1.Pod)
-	podName := pod.ObjectMeta.Name
-	glog.V(5).Infof("Pod added: %s", podName)
-	networks, ok := pod.Annotations["networks"]
-	if !ok {
-		glog.V(5).Infof("Pod %s does not contain any networks, skipping", podName)
-		return
+	key := c.configStore.getConfigRecordKey(podObj.GetNamespace(), podObj.GetName(), networkName)
+	sameExpected := cfgRecord != nil && cfgRecord.Expected.Optype == Add && isSameAttachment(cniParams, cfgRecord.Expected.Data)
+	networkErr := c.validateNetwork(cniParams)
+	// a pending delete of a missing network (i.e. detached once its Network
+	// got deleted, see detachNetworkPods) isn't overridden, the network
+	// attachment is added back once the Network is created again
+	if networkErr != nil && cfgRecord != nil && cfgRecord.Expected.Optype == Delete && cfgRecord.Running.State != Nil {
+		klog.V(4).InfoS("Network not found, keeping its pending delete", "pod", klog.KObj(podObj), "network", networkName)
+		return nil
+	}
+	// a network attachment that failed on its missing network is retried
+	// once the network is created
+	if sameExpected && cfgRecord.Running.State == Failed && !c.isNetworkChanged(cfgRecord.Running.Data) &&
+		(networkErr != nil || !isNetworkNotFound(cfgRecord.Running, cniParams)) {
+		klog.V(4).InfoS("Network failed, not retrying until it's changed", "pod", klog.KObj(podObj), "network", networkName, "reason", cfgRecord.Running.Reason)
+		return nil
+	}
+	if sameExpected && cfgRecord.Running.State == Active && isSameAttachment(cfgRecord.Expected.Data, cfgRecord.Running.Data) {
+		if !c.isNetworkUpdated(cfgRecord.Running.Data) {
+			return nil
+		}
+		// the worker, off the running config, deletes then adds back the
+		// network attachment
+		klog.V(3).InfoS("Network got updated, re-plugging it", "pod", klog.KObj(podObj), "network", networkName)
+		c.eventQueue.Enqueue(&Event{data: c.getCNIAttachmentTuple(podObj.GetNamespace(), podObj.GetName(), networkName)})
+		return nil
 	}
+	ev := &Event{data: c.getCNIAttachmentTuple(podObj.GetNamespace(), podObj.GetName(), networkName)}
+	// a missing network is a permanent failure, the worker marks the network
+	// attachment Failed and the Pod get synced again once the network is
+	// created (see syncNetworkPods)
+	if networkErr != nil {
+		if !sameExpected {
+			if err := c.configStore.saveExpectedConfig(key, ExpectedConfig{Optype: Add, Data: cniParams}); err != nil {
+				return err
+			}
+		}
+		c.eventQueue.Enqueue(ev)
+		return nil
+	}
+	if sameExpected {
+		// a failed attachment is retried with backoff, the Pod's updates
+		// (e.g. its networks status) don't hasten it
+		if c.eventQueue.Retrying(ev) {
+			return nil
+		}
+		klog.V(4).InfoS("Retrying network", "pod", klog.KObj(podObj), "network", networkName, "state", cfgRecord.Running.State)
+	} else {
+		err = c.configStore.saveExpectedConfig(key, ExpectedConfig{Optype: Add, Data: cniParams})
+		if err != nil {
+			return err
+		}
+	}
+	c.eventQueue.Enqueue(ev)
 
-	c.addNetworks(pod, networks)
+	return nil
 }
 
-func (c *Controller) podUpdated(oldObj, newObj interface{}) {
-	oldPod := oldObj.(*apiv1.Pod)
-	newPod := newObj.(*apiv1.Pod)
-	podName := oldPod.ObjectMeta.Name
-	glog.V(5).Infof("Pod updated: %s", podName)
-	if oldNetworks, ok := oldPod.Annotations["networks"]; ok {
-		oldNetSet, err := getNetworkSet(oldNetworks)
+// delNetwork records the intent of detaching networkName from the Pod
+// namespace/podName and queue an event for the worker unless cfgRecord shows
+// it already detached
+func (c *Controller) delNetwork(namespace, podName, networkName string, cfgRecord ConfigRecord) error {
+	if cfgRecord.Expected.Optype == Delete && cfgRecord.Running.State == Nil {
+		return nil
+	}
+
+	key := c.configStore.getConfigRecordKey(namespace, podName, networkName)
+	ev := &Event{data: c.getCNIAttachmentTuple(namespace, podName, networkName)}
+	if cfgRecord.Expected.Optype != Delete {
+		// keep the attachment's identity in the record, it's needed to
+		// match the record with its Pod (see getPodConfigRecords)
+		err := c.configStore.saveExpectedConfig(key, ExpectedConfig{Optype: Delete, Data: cfgRecord.Expected.Data})
 		if err != nil {
-			glog.V(4).Infof("Failed to unmarshall pod's %s old networks annotation, ignore: %s", podName, err)
-			return
+			return err
 		}
-		if newNetworks, ok := newPod.Annotations["networks"]; ok {
-			newNetSet, err := getNetworkSet(newNetworks)
-			if err != nil {
-				glog.V(4).Infof("Failed to unmarshall pod's %s new networks annotation, ignore: %s", podName, err)
-				return
-			}
-			if d := oldNetSet.Difference(newNetSet); d.Size() > 0 {
-				glog.V(5).Infof("The following network(s) got deleted from Pod %s: %s", podName, d)
-				for _, netKV := range d.ToSlice() {
-					err := c.delNetwork(newPod, netKV.Key, netKV.Val.(cniPodNetworkProperty))
-					if err != nil {
-						glog.Errorf("Failed to delete network %s on pod %s", netKV.Key, podName)
-					}
-				}
-			}
-			if d := newNetSet.Difference(oldNetSet); d.Size() > 0 {
-				glog.V(5).Infof("The following network(s) got added to Pod %s: %s", podName, d)
-				for _, netKV := range d.ToSlice() {
-					err := c.addNetwork(newPod, netKV.Key, netKV.Val.(cniPodNetworkProperty))
-					if err != nil {
-						glog.Errorf("Failed to add network %s on pod %s", netKV.Key, podName)
-					}
-				}
-			}
-		} else {
-			glog.V(5).Infof("Pod's %s networks annotation '%s' got deleted", podName, oldNetworks)
-			nets, err := getNetworks(oldNetworks)
+	} else if c.eventQueue.Retrying(ev) {
+		// retried with backoff, see addNetwork
+		return nil
+	}
+	c.eventQueue.Enqueue(ev)
+	return nil
+}
+
+// getPodConfigRecords returns the ConfigStore records of a Pod keyed by network name
+func (c *Controller) getPodConfigRecords(namespace, podName string) (map[string]ConfigRecord, error) {
+	cfgRecords := c.configStore.listPodConfigRecords(namespace + "/" + podName)
+	podCfgRecords := make(map[string]ConfigRecord)
+	for _, cfgRecord := range cfgRecords {
+		cniParams, err := getCNIParams(cfgRecord.Expected.Data)
+		if err != nil || cniParams.PodName == "" {
+			// a record of a Delete expected config prior to
+			// saving its data, use the running one instead
+			cniParams, err = getCNIParams(cfgRecord.Running.Data)
 			if err != nil {
-				glog.V(4).Infof("Failed to unmarshall pod's %s old networks annotation, ignore: %s", podName, err)
-				return
-			}
-			for _, n := range nets {
-				np := n.ToProperty()
-				err := c.delNetwork(newPod, n.NetworkName, np)
-				if err != nil {
-					glog.Errorf("Failed to delete network %s on pod %s", n.NetworkName, podName)
-				}
+				continue
 			}
 		}
-	} else if newNetworks, ok := newPod.Annotations["networks"]; ok {
-		c.addNetworks(newPod, newNetworks)
+		if cniParams.Namespace == namespace && cniParams.PodName == podName {
+			podCfgRecords[getAttachmentName(cniParams.NetworkNamespace, cniParams.NetworkName)] = cfgRecord
+		}
 	}
+	return podCfgRecords, nil
 }
 
-func (c *Controller) podDeleted(podObj interface{}) {
-	pod := podObj.(*apiv1.Pod)
-	podName := pod.ObjectMeta.Name
-	glog.V(5).Infof("Pod Deleted: %s", podName)
-	networks, ok := pod.Annotations["networks"]
-	if !ok {
-		glog.V(5).Infof("Pod %s does not contain any networks, skipping", podName)
+// syncPod reconciles the network attachments of the Pod identified by key
+// (i.e. namespace/name): the networks off the Pod's current networks
+// annotation are compared against the Pod's records in the ConfigStore and
+// an event is queued for every network attachment not in its expected state
+func (c *Controller) syncPod(key string) {
+	namespace, podName, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		klog.ErrorS(err, "Invalid Pod key", "key", key)
+		return
+	}
+	podRef := klog.KRef(namespace, podName)
+	cfgRecords, err := c.getPodConfigRecords(namespace, podName)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get Pod's config records", "pod", podRef)
 		return
 	}
 
-	c.delPendingNetworks(pod, networks)
-}
+	pod, err := c.podLister.Pods(namespace).Get(podName)
+	if apierrors.IsNotFound(err) {
+		c.statuses.forget(key)
+		if len(cfgRecords) == 0 {
+			return
+		}
+		// whether the Pod got deleted or is no longer managed is checked
+		// by the worker (see isPodGone)
+		c.releasePodNetworks(namespace, podName, cfgRecords)
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "Failed to get Pod from the cache", "pod", podRef)
+		return
+	}
 
-func (c *Controller) delPendingNetworks(pod *apiv1.Pod, networkAnnotation string) {
-	podName := pod.ObjectMeta.Name
-	glog.V(5).Infof("Pod's %s with networks annotation '%s' got deleted", podName, networkAnnotation)
-	nets, err := getNetworks(networkAnnotation)
+	nets, err := getPodNetworks(pod)
 	if err != nil {
-		glog.V(4).Infof("Failed to unmarshall pod's %s existing networks annotation, ignore: %s", podName, err)
+		klog.V(4).InfoS("Ignoring Pod's invalid networks annotation", "pod", podRef, "err", err)
 		return
 	}
 
+	// the interfaces of the network attachments added, or being deleted,
+	// keyed by interface name
+	busyIfNames := make(map[string]string)
+	for networkName, cfgRecord := range cfgRecords {
+		if ifName := getRecordInterfaceName(cfgRecord); ifName != "" {
+			busyIfNames[ifName] = networkName
+		}
+	}
+	seen := make(map[string]bool)
+	ifNames := make(map[string]string)
+	addNets := cniPodNetworks{}
+	addCfgRecords := make(map[string]*ConfigRecord)
 	for _, n := range nets {
-		key := c.configStore.getConfigRecordKey(podName, n.NetworkName)
-		c.configStore.delConfigRecord(key)
-		glog.V(5).Infof("Pod's %s pending network '%s' got deleted", podName, n.NetworkName)
+		networkName := n.attachmentName(namespace)
+		if seen[networkName] {
+			klog.InfoS("Ignoring network listed more than once", "pod", podRef, "network", networkName)
+			continue
+		}
+		seen[networkName] = true
+		if r, ok := cfgRecords[networkName]; ok {
+			addCfgRecords[networkName] = &r
+			delete(cfgRecords, networkName)
+		}
+		if !n.IsPrimary && !n.PodagentSkip {
+			if err := validateInterface(n, networkName, ifNames); err != nil {
+				klog.ErrorS(err, "Invalid network interface", "pod", podRef, "network", networkName)
+				c.recorder.Eventf(pod, apiv1.EventTypeWarning, "InvalidInterface", "network %s: %v", networkName, err)
+				continue
+			}
+		}
+		addNets = append(addNets, n)
+	}
+	// what is left are networks that are no longer in the annotation, they
+	// are deleted first so that their interface names can be reused
+	for networkName, cfgRecord := range cfgRecords {
+		if cfgRecord.Expected.Optype == Delete && cfgRecord.Running.State == Failed {
+			klog.V(4).InfoS("Network failed to be deleted, not retrying", "pod", podRef, "network", networkName, "reason", cfgRecord.Running.Reason)
+			continue
+		}
+		klog.V(5).InfoS("Network got removed from the Pod", "pod", podRef, "network", networkName)
+		err := c.delNetwork(namespace, podName, networkName, cfgRecord)
+		if err != nil {
+			klog.ErrorS(err, "Failed to delete network", "pod", podRef, "network", networkName)
+		}
+	}
+	for _, n := range addNets {
+		networkName := n.attachmentName(namespace)
+		// the add is deferred until the interface is released by the
+		// network attachment holding it, otherwise its delete (e.g. one
+		// retried with backoff) would tear the added interface down
+		if other, ok := busyIfNames[getInterfaceName(n)]; ok && other != networkName && !n.IsPrimary && !n.PodagentSkip {
+			klog.V(3).InfoS("Deferring network, its interface is used by another network", "pod", podRef, "network", networkName,
+				"interface", getInterfaceName(n), "otherNetwork", other)
+			continue
+		}
+		err := c.addNetwork(pod, n, addCfgRecords[networkName])
+		if err != nil {
+			klog.ErrorS(err, "Failed to add network", "pod", podRef, "network", networkName)
+		}
+	}
+	c.statuses.schedule(key)
+}
+
+// getInterfaceName returns the network device name of a network attachment,
+// if not specified it's derived off the network name
+func getInterfaceName(n cniPodNetwork) string {
+	if n.Interface != "" {
+		return n.Interface
+	}
+	return kc.GetNetworkIfname(n.NetworkName)
+}
+
+// getRecordInterfaceName returns the network device name of a network
+// attachment that's added, or might be, off its running config, "" if
+// it's not added
+func getRecordInterfaceName(cfgRecord ConfigRecord) string {
+	if cfgRecord.Running.State == Nil || cfgRecord.Running.Data == nil {
+		return ""
+	}
+	cniParams, err := getCNIParams(cfgRecord.Running.Data)
+	if err != nil || cniParams.NetworkName == "" {
+		return ""
+	}
+	if cniParams.IfName != "" {
+		return cniParams.IfName
+	}
+	return kc.GetNetworkIfname(cniParams.NetworkName)
+}
+
+// validateInterface validates the network device name of the network
+// attachment networkName against the kernel naming rules and the names
+// used by the other network attachments of the Pod (ifNames, updated with
+// the network device name if it's valid)
+func validateInterface(n cniPodNetwork, networkName string, ifNames map[string]string) error {
+	ifName := getInterfaceName(n)
+	if err := validateInterfaceName(ifName); err != nil {
+		return err
+	}
+	if other, ok := ifNames[ifName]; ok {
+		return fmt.Errorf("interface %s is already used by network %s", ifName, other)
+	}
+	ifNames[ifName] = networkName
+	return nil
+}
+
+// validateInterfaceName validates a network device name as the kernel does
+// (see dev_valid_name), "lo" and "eth0" (i.e. the primary network's) are reserved
+func validateInterfaceName(ifName string) error {
+	switch {
+	case ifName == "":
+		return fmt.Errorf("empty interface name")
+	case len(ifName) > maxInterfaceNameLength:
+		return fmt.Errorf("interface name %q is longer than %d characters", ifName, maxInterfaceNameLength)
+	case ifName == "." || ifName == "..":
+		return fmt.Errorf("invalid interface name %q", ifName)
+	case ifName == "lo" || ifName == "eth0":
+		return fmt.Errorf("interface name %q is reserved", ifName)
+	}
+	for _, r := range ifName {
+		if r == '/' || r == ':' || unicode.IsSpace(r) {
+			return fmt.Errorf("interface name %q has an invalid character %q", ifName, r)
+		}
+	}
+	return nil
+}
+
+// releasePodNetworks handles the records of a Pod missing from the cache:
+// the network attachments that have been (or might have been) added get a
+// best-effort delete by the worker, if the Pod got deleted rather than
+// deselected (see isPodGone), to release their resources (e.g. ipam) before
+// their records are removed, the other records are removed right away
+func (c *Controller) releasePodNetworks(namespace, podName string, cfgRecords map[string]ConfigRecord) {
+	for networkName, cfgRecord := range cfgRecords {
+		if cfgRecord.Running.State == Nil {
+			key := c.configStore.getConfigRecordKey(namespace, podName, networkName)
+			c.configStore.delConfigRecord(key)
+			klog.V(5).InfoS("Deleted pending network of deleted Pod", "pod", klog.KRef(namespace, podName), "network", networkName)
+			continue
+		}
+		if err := c.delNetwork(namespace, podName, networkName, cfgRecord); err != nil {
+			klog.ErrorS(err, "Failed to release network of deleted Pod", "pod", klog.KRef(namespace, podName), "network", networkName)
+		}
 	}
 }
 
-func (c *Controller) addNetworks(pod *apiv1.Pod, networkAnnotation string) {
-	podName := pod.ObjectMeta.Name
-	glog.V(5).Infof("Pod's %s networks annotation '%s' got added", podName, networkAnnotation)
-	nets, err := getNetworks(networkAnnotation)
+// isPodGone returns true if the Pod of a record doesn't exist anymore,
+// deselected is true if it's missing from the cache of the managed Pods
+// while still running (see isPodDeselected)
+func (c *Controller) isPodGone(ctx context.Context, cfgRecord ConfigRecord) (gone, deselected bool) {
+	if c.podLister == nil || !c.podsSynced() {
+		return false, false
+	}
+	cniParams, err := getCNIParams(cfgRecord.Expected.Data)
+	if err != nil || cniParams.PodName == "" {
+		cniParams, err = getCNIParams(cfgRecord.Running.Data)
+		if err != nil || cniParams.PodName == "" {
+			return false, false
+		}
+	}
+	pod, err := c.podLister.Pods(cniParams.Namespace).Get(cniParams.PodName)
+	if apierrors.IsNotFound(err) {
+		deselected = c.isPodDeselected(ctx, cniParams.Namespace, cniParams.PodName, map[string]ConfigRecord{"": cfgRecord})
+		return !deselected, deselected
+	}
 	if err != nil {
-		glog.V(4).Infof("Failed to unmarshall pod's %s new networks annotation, ignore: %s", podName, err)
-		return
+		return false, false
 	}
+	// a new Pod with the same name (e.g. a StatefulSet's one)
+	return cniParams.PodUID != "" && string(pod.UID) != cniParams.PodUID, false
+}
 
-	for _, n := range nets {
-		np := n.ToProperty()
-		err := c.addNetwork(pod, n.NetworkName, np)
-		if err != nil {
-			glog.Errorf("Failed to add network %s on pod %s", n.NetworkName, podName)
+// isPodDeselected returns true if the Pod namespace/podName, missing from
+// the cache of the managed Pods, is still running: it's no longer selected
+// (e.g. its labels or the managed namespaces changed) rather than deleted,
+// its networks, off cfgRecords, are kept. It's checked off the apiserver,
+// or off the runtime's sandboxes if the apiserver is unavailable
+func (c *Controller) isPodDeselected(ctx context.Context, namespace, podName string, cfgRecords map[string]ConfigRecord) bool {
+	var podUID string
+	sandboxIDs := make(map[string]bool)
+	for _, cfgRecord := range cfgRecords {
+		if cniParams, err := getCNIParams(cfgRecord.Expected.Data); err == nil && cniParams.PodUID != "" {
+			podUID = cniParams.PodUID
 		}
+		if cniParams, err := getCNIParams(cfgRecord.Running.Data); err == nil && cniParams.SandboxID != "" {
+			sandboxIDs[cniParams.SandboxID] = true
+		}
+	}
+
+	getCtx, cancel := context.WithTimeout(ctx, podGetTimeout)
+	defer cancel()
+	pod, err := c.kubeClient.CoreV1().Pods(namespace).Get(getCtx, podName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		return false
+	case err == nil:
+		// a new Pod with the same name (e.g. a StatefulSet's one) or a
+		// terminated one
+		return (podUID == "" || string(pod.UID) == podUID) && pod.Status.Phase == apiv1.PodRunning
+	}
+	klog.V(4).InfoS("Failed to get Pod missing from the cache, checking its sandbox", "pod", klog.KRef(namespace, podName), "err", err)
+	if c.runtime == nil || len(sandboxIDs) == 0 {
+		return false
+	}
+	ids, err := c.runtime.ListSandboxIDs(ctx)
+	if err != nil {
+		// neither the apiserver nor the cri are available, the Pod is
+		// checked again on the next resync
+		klog.ErrorS(err, "Failed to list sandboxes from cri")
+		return true
+	}
+	for _, id := range ids {
+		if sandboxIDs[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseLeakedNetworks releases the network attachments left in libcni's
+// cache by sandboxes that no longer exist
+func (c *Controller) releaseLeakedNetworks(ctx context.Context) {
+	if c.runtime == nil {
+		return
+	}
+	sandboxIDs, err := c.runtime.ListSandboxIDs(ctx)
+	if err != nil {
+		klog.ErrorS(err, "Failed to list sandboxes from cri")
+		return
+	}
+	sandboxes := make(map[string]bool, len(sandboxIDs))
+	for _, id := range sandboxIDs {
+		sandboxes[id] = true
+	}
+	c.cniPlugin.ReleaseLeakedNetworks(ctx, func(sandboxID string) bool { return sandboxes[sandboxID] }, leakedNetworkMinAge)
+}
+
+// syncConfigStore reconciles the Pods having records in the ConfigStore,
+// it covers Pods deleted while their delete event has been missed
+func (c *Controller) syncConfigStore() {
+	for _, key := range c.configStore.listPods() {
+		c.syncPod(key)
+	}
+}
+
+// podKeyRef returns the logging reference of the Pod whose key is key
+func podKeyRef(key string) klog.ObjectRef {
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	return klog.KRef(namespace, name)
+}
+
+func (c *Controller) podAdded(podObj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(podObj)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get key of added Pod")
+		return
 	}
+	klog.V(5).InfoS("Pod added", "pod", podKeyRef(key))
+	c.syncPod(key)
 }
 
-func (c *Controller) eventQueueWorker() {
+// podUpdated is also called on every resync, in that case oldObj and newObj
+// are the same but the Pod get reconciled nonetheless
+func (c *Controller) podUpdated(oldObj, newObj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(newObj)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get key of updated Pod")
+		return
+	}
+	klog.V(5).InfoS("Pod updated", "pod", podKeyRef(key))
+	c.syncPod(key)
+}
+
+func (c *Controller) podDeleted(podObj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(podObj)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get key of deleted Pod")
+		return
+	}
+	klog.V(5).InfoS("Pod deleted", "pod", podKeyRef(key))
+	c.syncPod(key)
+}
+
+// eventQueueWorker processes the queued events until ctx is done, the
+// cni-plugins invoked by an in-flight event get killed then
+func (c *Controller) eventQueueWorker(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		c.eventQueue.cond.L.Lock()
+		c.eventQueue.cond.Broadcast()
+		c.eventQueue.cond.L.Unlock()
+	}()
 	for {
 		c.eventQueue.cond.L.Lock()
 
-		for c.eventQueue.q.Len() == 0 {
+		for c.eventQueue.q.Len() == 0 && ctx.Err() == nil {
 			c.eventQueue.cond.Wait()
 		}
+		if ctx.Err() != nil {
+			c.eventQueue.cond.L.Unlock()
+			klog.InfoS("Stopping the event queue worker", "reason", ctx.Err())
+			return
+		}
 
 		ev := c.eventQueue.Dequeue()
 		c.eventQueue.cond.L.Unlock()
 
 		if ev != nil {
-			glog.V(5).Infof("Processing event:", ev)
-			c.Process(ev)
+			klog.V(5).InfoS("Processing event", "event", ev.data)
+			c.Process(ctx, ev)
 		}
 	}
 }
 
-func (c *Controller) watchPods(ctx context.Context, nodeName string) (cache.Controller, error) {
+func (c *Controller) watchPods(ctx context.Context, nodeName string) error {
+	source := c.podSource
+	if source == nil {
+		source = newInformerPodSource(c.kubeClient, nodeName, c.podSelection, c.resyncPeriod)
+	}
+	c.podLister = source.lister()
+	c.podsSynced = source.hasSynced
 
 	// Initialize the worker queue
-	go c.eventQueueWorker()
-
-	// Currently there is no field selector for a Pod annotation
-	// https://github.com/kubernetes/kubernetes/blob/master/pkg/registry/core/pod/strategy.go
-	fs := fields.Set{
-		"status.phase": "Running",
-	}
-	if nodeName != "" {
-		fs["spec.nodeName"] = nodeName
-	}
-	fieldsToMatch := fs.AsSelector()
-	// Define what we want to look for (Pods)
-	watchlist := cache.NewListWatchFromClient(c.kubeClient.CoreV1().RESTClient(), "pods", apiv1.NamespaceAll, fieldsToMatch)
-	// Setup an informer to call functions when the watchlist changes
-	_, controller := cache.NewInformer(
-		watchlist,
-		&apiv1.Pod{},
-		// we don't use any resync because UpdateFunc logic currently compares
-		// the annotations between the old and new objects, but during a resync,
-		// old == new so nothing happens
-		0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc:    c.podAdded,
-			UpdateFunc: c.podUpdated,
-			DeleteFunc: c.podDeleted,
-		},
-	)
-
-	//Run the controller as a goroutine
-	go controller.Run(ctx.Done())
-	return controller, nil
+	go c.eventQueueWorker(ctx)
+	// the checks of the network attachments interrupted by a crash are
+	// queued ahead of the events from the informer
+	c.checkNetworks(Dirty)
+
+	err := source.start(ctx, cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.podAdded,
+		UpdateFunc: c.podUpdated,
+		DeleteFunc: c.podDeleted,
+	})
+	if err != nil {
+		return err
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), source.hasSynced) {
+		return fmt.Errorf("timed out waiting for the Pods cache to sync")
+	}
+	c.podsCacheSynced.Store(true)
+
+	// Pods deleted while podagent was down are not in the informer's cache
+	go wait.Until(c.syncConfigStore, c.resyncPeriod, ctx.Done())
+	go wait.Until(func() { c.releaseLeakedNetworks(ctx) }, c.resyncPeriod, ctx.Done())
+	if c.checkPeriod > 0 {
+		go wait.Until(func() { c.checkNetworks(Active) }, c.checkPeriod, ctx.Done())
+	}
+	return nil
 }
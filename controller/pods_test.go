@@ -0,0 +1,109 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+)
+
+func TestValidateCapabilityArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		n       cniPodNetwork
+		invalid bool
+	}{
+		{name: "none"},
+		{name: "ips", n: cniPodNetwork{IPs: []string{"10.0.0.1", "10.0.1.1/24", "fd00::1/64"}}},
+		{name: "invalid ip", n: cniPodNetwork{IPs: []string{"10.0.0.256"}}, invalid: true},
+		{name: "mac", n: cniPodNetwork{NetworkConfig: kc.NetworkConfig{IfMAC: "02:00:00:00:00:01"}}},
+		{name: "invalid mac", n: cniPodNetwork{NetworkConfig: kc.NetworkConfig{IfMAC: "02:00:00"}}, invalid: true},
+		{name: "bandwidth", n: cniPodNetwork{Bandwidth: &cni.BandwidthEntry{IngressRate: 1000, IngressBurst: 100}}},
+		{name: "negative bandwidth", n: cniPodNetwork{Bandwidth: &cni.BandwidthEntry{EgressRate: -1}}, invalid: true},
+		{name: "port mapping", n: cniPodNetwork{PortMappings: []cni.PortMapEntry{{HostPort: 8080, ContainerPort: 80, Protocol: "UDP", HostIP: "10.0.0.1"}}}},
+		{name: "host port out of range", n: cniPodNetwork{PortMappings: []cni.PortMapEntry{{HostPort: 65536, ContainerPort: 80}}}, invalid: true},
+		{name: "no container port", n: cniPodNetwork{PortMappings: []cni.PortMapEntry{{HostPort: 8080}}}, invalid: true},
+		{name: "invalid protocol", n: cniPodNetwork{PortMappings: []cni.PortMapEntry{{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}}}, invalid: true},
+		{name: "invalid host ip", n: cniPodNetwork{PortMappings: []cni.PortMapEntry{{HostPort: 8080, ContainerPort: 80, HostIP: "localhost"}}}, invalid: true},
+	} {
+		err := validateCapabilityArgs(tc.n)
+		if tc.invalid != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+func TestValidateCapabilityArgsProtocol(t *testing.T) {
+	// the port mappings' protocol is normalized
+	n := cniPodNetwork{PortMappings: []cni.PortMapEntry{{HostPort: 8080, ContainerPort: 80}, {HostPort: 5353, ContainerPort: 53, Protocol: "UDP"}}}
+	if err := validateCapabilityArgs(n); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n.PortMappings[0].Protocol != "tcp" || n.PortMappings[1].Protocol != "udp" {
+		t.Fatalf("Unexpected protocols %q, %q", n.PortMappings[0].Protocol, n.PortMappings[1].Protocol)
+	}
+}
+
+func TestValidateInterface(t *testing.T) {
+	ifNames := make(map[string]string)
+	for _, tc := range []struct {
+		name    string
+		n       cniPodNetwork
+		invalid bool
+	}{
+		{name: "derived off the network name", n: cniPodNetwork{NetworkConfig: kc.NetworkConfig{NetworkName: "green"}}},
+		{name: "chosen", n: cniPodNetwork{NetworkConfig: kc.NetworkConfig{NetworkName: "red"}, Interface: "data0"}},
+		{name: "already used", n: cniPodNetwork{NetworkConfig: kc.NetworkConfig{NetworkName: "blue"}, Interface: "data0"}, invalid: true},
+		{name: "too long", n: cniPodNetwork{Interface: "data0123456789ab"}, invalid: true},
+		{name: "reserved", n: cniPodNetwork{Interface: "eth0"}, invalid: true},
+		{name: "loopback", n: cniPodNetwork{Interface: "lo"}, invalid: true},
+		{name: "dot", n: cniPodNetwork{Interface: ".."}, invalid: true},
+		{name: "slash", n: cniPodNetwork{Interface: "data/0"}, invalid: true},
+		{name: "colon", n: cniPodNetwork{Interface: "data:0"}, invalid: true},
+		{name: "space", n: cniPodNetwork{Interface: "data 0"}, invalid: true},
+		{name: "max length", n: cniPodNetwork{Interface: "data0123456789a"}},
+	} {
+		err := validateInterface(tc.n, tc.name, ifNames)
+		if tc.invalid != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args    map[string]string
+		invalid bool
+	}{
+		{args: nil},
+		{args: map[string]string{"VLAN": "100", "MTU": ""}},
+		{args: map[string]string{"": "100"}, invalid: true},
+		{args: map[string]string{"IgnoreUnknown": "0"}, invalid: true},
+		{args: map[string]string{"K8S_POD_NAME": "other"}, invalid: true},
+		{args: map[string]string{"VLAN;MTU": "100"}, invalid: true},
+		{args: map[string]string{"VLAN": "100;MTU=9000"}, invalid: true},
+		{args: map[string]string{"VLAN=100": ""}, invalid: true},
+	} {
+		err := validateArgs(cniPodNetwork{NetworkConfig: kc.NetworkConfig{NetworkName: "green"}, Args: tc.args})
+		if tc.invalid != (err != nil) {
+			t.Errorf("%v: unexpected error %v", tc.args, err)
+		}
+	}
+}
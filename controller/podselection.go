@@ -0,0 +1,122 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// podSelection the Pods managed by the podagent, they're selected by the
+// apiserver so that the other Pods are neither watched nor cached
+type podSelection struct {
+	// labelSelector the labels of the managed Pods, empty for all Pods
+	labelSelector string
+	// namespaces the namespaces of the managed Pods, empty for all of them
+	// but excludedNamespaces
+	namespaces []string
+	// excludedNamespaces the namespaces whose Pods aren't managed
+	excludedNamespaces []string
+}
+
+// newPodSelection validates the selection of the managed Pods, the
+// excluded namespaces are removed off the allowed ones, if any
+func newPodSelection(labelSelector string, namespaces, excludedNamespaces []string) (*podSelection, error) {
+	if _, err := labels.Parse(labelSelector); err != nil {
+		return nil, fmt.Errorf("invalid pod label selector %q: %v", labelSelector, err)
+	}
+	excluded := make(map[string]bool)
+	for _, ns := range excludedNamespaces {
+		excluded[ns] = true
+	}
+	s := &podSelection{labelSelector: labelSelector}
+	seen := make(map[string]bool)
+	for _, ns := range namespaces {
+		if ns == "" || seen[ns] {
+			continue
+		}
+		seen[ns] = true
+		if !excluded[ns] {
+			s.namespaces = append(s.namespaces, ns)
+		}
+	}
+	if len(namespaces) > 0 && len(s.namespaces) == 0 {
+		return nil, fmt.Errorf("every allowed namespace %v is excluded", namespaces)
+	}
+	if len(s.namespaces) == 0 {
+		for ns := range excluded {
+			if ns != "" {
+				s.excludedNamespaces = append(s.excludedNamespaces, ns)
+			}
+		}
+		sort.Strings(s.excludedNamespaces)
+	}
+	return s, nil
+}
+
+// fieldSelector returns the field selector of the managed Pods off the
+// fields fs, i.e. fs and not in the excluded namespaces
+func (s *podSelection) fieldSelector(fs fields.Set) string {
+	selectors := []fields.Selector{fs.AsSelector()}
+	for _, ns := range s.excludedNamespaces {
+		selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", ns))
+	}
+	return fields.AndSelectors(selectors...).String()
+}
+
+// multiNamespacePodLister a PodLister over the listers of the Pods of
+// several namespaces, keyed by namespace
+type multiNamespacePodLister map[string]corelisters.PodLister
+
+var _ corelisters.PodLister = multiNamespacePodLister{}
+
+func (l multiNamespacePodLister) List(selector labels.Selector) ([]*apiv1.Pod, error) {
+	var pods []*apiv1.Pod
+	for _, lister := range l {
+		nsPods, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, nsPods...)
+	}
+	return pods, nil
+}
+
+func (l multiNamespacePodLister) Pods(namespace string) corelisters.PodNamespaceLister {
+	if lister, ok := l[namespace]; ok {
+		return lister.Pods(namespace)
+	}
+	return unmanagedNamespacePodLister(namespace)
+}
+
+// unmanagedNamespacePodLister the PodNamespaceLister of a namespace whose
+// Pods aren't managed, it has no Pods
+type unmanagedNamespacePodLister string
+
+func (l unmanagedNamespacePodLister) List(selector labels.Selector) ([]*apiv1.Pod, error) {
+	return nil, nil
+}
+
+func (l unmanagedNamespacePodLister) Get(name string) (*apiv1.Pod, error) {
+	return nil, apierrors.NewNotFound(apiv1.Resource("pods"), name)
+}
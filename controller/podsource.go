@@ -0,0 +1,124 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podSource the source of the managed Pods of the node, it caches them
+// (see stripPod) and calls a handler on their additions, updates and
+// deletions, as well as on every resync period
+type podSource interface {
+	// lister returns the lister of the cached Pods
+	lister() corelisters.PodLister
+	// hasSynced returns true once the cache is filled
+	hasSynced() bool
+	// start starts feeding the cache and handler until ctx is done
+	start(ctx context.Context, handler cache.ResourceEventHandler) error
+}
+
+// informerPodSource the Pods watched on the apiserver, the default source
+type informerPodSource struct {
+	factories    []informers.SharedInformerFactory
+	podInformers []cache.SharedIndexInformer
+	podLister    corelisters.PodLister
+}
+
+var _ podSource = &informerPodSource{}
+
+// newInformerPodSource returns the source of the running Pods of the node
+// nodeName, all nodes if empty, selected by selection
+func newInformerPodSource(kubeClient kubernetes.Interface, nodeName string, selection *podSelection, resyncPeriod time.Duration) *informerPodSource {
+	// Currently there is no field selector for a Pod annotation
+	// https://github.com/kubernetes/kubernetes/blob/master/pkg/registry/core/pod/strategy.go
+	// the managed Pods can be selected off their labels and namespaces though
+	fs := fields.Set{
+		"status.phase": "Running",
+	}
+	if nodeName != "" {
+		fs["spec.nodeName"] = nodeName
+	}
+	fieldsToMatch := selection.fieldSelector(fs)
+	tweakListOptions := informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fieldsToMatch
+		options.LabelSelector = selection.labelSelector
+	})
+	// every resyncPeriod the informer calls UpdateFunc for all the Pods in
+	// its cache, syncPod being level based, any missed or failed network
+	// attachment transition get corrected
+	s := &informerPodSource{}
+	if len(selection.namespaces) == 0 {
+		factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, resyncPeriod, tweakListOptions)
+		podInformer := factory.Core().V1().Pods()
+		s.podLister = podInformer.Lister()
+		s.factories = append(s.factories, factory)
+		s.podInformers = append(s.podInformers, podInformer.Informer())
+		return s
+	}
+	// the apiserver selects a single namespace, every allowed one gets its
+	// own informer
+	podListers := make(multiNamespacePodLister)
+	for _, ns := range selection.namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, resyncPeriod,
+			tweakListOptions, informers.WithNamespace(ns))
+		podInformer := factory.Core().V1().Pods()
+		podListers[ns] = podInformer.Lister()
+		s.factories = append(s.factories, factory)
+		s.podInformers = append(s.podInformers, podInformer.Informer())
+	}
+	s.podLister = podListers
+	return s
+}
+
+func (s *informerPodSource) lister() corelisters.PodLister {
+	return s.podLister
+}
+
+func (s *informerPodSource) hasSynced() bool {
+	for _, podInformer := range s.podInformers {
+		if !podInformer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *informerPodSource) start(ctx context.Context, handler cache.ResourceEventHandler) error {
+	for _, podInformer := range s.podInformers {
+		// only the fields read by the podagent are cached
+		if err := podInformer.SetTransform(stripPod); err != nil {
+			return fmt.Errorf("failed to set the Pod informer's transform: %w", err)
+		}
+		if _, err := podInformer.AddEventHandler(handler); err != nil {
+			return fmt.Errorf("failed to add the Pod informer's handler: %w", err)
+		}
+	}
+	for _, factory := range s.factories {
+		factory.Start(ctx.Done())
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// networksReadyCondition the readiness gate condition type maintained by
+// the podagent on the Pods declaring it in their spec.readinessGates
+const networksReadyCondition apiv1.PodConditionType = "podagent.kaloom.com/networks-ready"
+
+const (
+	networksReadyReason   = "NetworksReady"
+	networksPendingReason = "NetworksPending"
+	networksFailedReason  = "NetworksFailed"
+	invalidNetworksReason = "InvalidNetworksAnnotation"
+)
+
+// hasNetworksReadinessGate returns true if the Pod declares the networks
+// readiness gate
+func hasNetworksReadinessGate(pod *apiv1.Pod) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == networksReadyCondition {
+			return true
+		}
+	}
+	return false
+}
+
+// getNetworksReadyCondition returns the networks readiness gate condition
+// of a Pod, it's True once every network attachment of the Pod's
+// annotations (but the primary and skipped ones) is Active
+func (c *Controller) getNetworksReadyCondition(pod *apiv1.Pod) apiv1.PodCondition {
+	cond := apiv1.PodCondition{Type: networksReadyCondition, Status: apiv1.ConditionFalse}
+	nets, err := getPodNetworks(pod)
+	if err != nil {
+		cond.Reason = invalidNetworksReason
+		cond.Message = err.Error()
+		return cond
+	}
+	cfgRecords, err := c.getPodConfigRecords(pod.Namespace, pod.Name)
+	if err != nil {
+		cond.Reason = networksPendingReason
+		cond.Message = err.Error()
+		return cond
+	}
+
+	var pending, failed []string
+	seen := make(map[string]bool)
+	for _, n := range nets {
+		networkName := n.attachmentName(pod.Namespace)
+		if n.IsPrimary || n.PodagentSkip || seen[networkName] {
+			continue
+		}
+		seen[networkName] = true
+		cfgRecord, ok := cfgRecords[networkName]
+		switch {
+		case !ok || cfgRecord.Expected.Optype != Add:
+			pending = append(pending, networkName)
+		case cfgRecord.Running.State == Failed:
+			failed = append(failed, networkName)
+		case cfgRecord.Running.State != Active || !isSameAttachment(cfgRecord.Expected.Data, cfgRecord.Running.Data):
+			pending = append(pending, networkName)
+		}
+	}
+	sort.Strings(pending)
+	sort.Strings(failed)
+	var msgs []string
+	if len(failed) > 0 {
+		cond.Reason = networksFailedReason
+		msgs = append(msgs, "failed: "+strings.Join(failed, ", "))
+	}
+	if len(pending) > 0 {
+		if cond.Reason == "" {
+			cond.Reason = networksPendingReason
+		}
+		msgs = append(msgs, "pending: "+strings.Join(pending, ", "))
+	}
+	if len(msgs) == 0 {
+		cond.Status = apiv1.ConditionTrue
+		cond.Reason = networksReadyReason
+		return cond
+	}
+	cond.Message = strings.Join(msgs, "; ")
+	return cond
+}
+
+// syncNetworksReady updates the networks readiness gate condition of the
+// Pod, if it declares it, when it's changed. It's written along with the
+// networks status annotation (see writePodStatus), off the handlers path
+func (c *Controller) syncNetworksReady(pod *apiv1.Pod) {
+	if !hasNetworksReadinessGate(pod) {
+		return
+	}
+	cond := c.getNetworksReadyCondition(pod)
+	for _, curr := range pod.Status.Conditions {
+		if curr.Type != networksReadyCondition {
+			continue
+		}
+		if curr.Status == cond.Status && curr.Reason == cond.Reason && curr.Message == cond.Message {
+			return
+		}
+		if curr.Status == cond.Status {
+			cond.LastTransitionTime = curr.LastTransitionTime
+		}
+	}
+	if cond.LastTransitionTime.IsZero() {
+		cond.LastTransitionTime = metav1.Now()
+	}
+
+	// the conditions are merged by type, the other ones are left as is
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []apiv1.PodCondition{cond},
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to encode pod's networks readiness patch", "pod", klog.KObj(pod))
+		return
+	}
+	klog.V(3).InfoS("Setting pod's condition", "pod", klog.KObj(pod), "condition", networksReadyCondition, "status", cond.Status, "message", cond.Message)
+	ctx, cancel := context.WithTimeout(context.Background(), podPatchTimeout)
+	defer cancel()
+	_, err = c.kubeClient.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
+	if err != nil {
+		klog.ErrorS(err, "Failed to patch pod's condition", "pod", klog.KObj(pod), "condition", networksReadyCondition)
+	}
+}
@@ -17,13 +17,20 @@ limitations under the License.
 
 package controller
 
-// Runtime interface
+import "context"
+
+// Runtime interface, its requests are cancelled once ctx is done and are
+// bounded by the runtime's own request timeout
 type Runtime interface {
 	// GetNetNS returns the network namespace of the given containerID. The ID
 	// supplied is typically the ID of a pod sandbox. This getter doesn't try
 	// to map non-sandbox IDs to their respective sandboxes.
-	GetNetNS(podSandboxID string) (string, error)
+	GetNetNS(ctx context.Context, podSandboxID string) (string, error)
 
 	// GetSandboxID returns kubernete's docker "pause" container ID
-	GetSandboxID(containerID string) (string, error)
+	GetSandboxID(ctx context.Context, containerID string) (string, error)
+
+	// ListSandboxIDs returns the IDs of all the pod sandboxes known to the
+	// runtime, whatever their state
+	ListSandboxIDs(ctx context.Context) ([]string, error)
 }
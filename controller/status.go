@@ -0,0 +1,278 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/kaloom/kubernetes-podagent/controller/cni"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// networksStatusAnnotation the Pod annotation holding the status of its
+// network attachments, a JSON map of attachmentStatus keyed by network
+const networksStatusAnnotation = "podagent.kaloom.com/networks-status"
+
+// defaultStatusInterval the default min interval between two writes of a
+// Pod's networks status annotation
+const defaultStatusInterval = 5 * time.Second
+
+// podPatchTimeout the timeout of the patch of a Pod's networks status
+// annotation or readiness gate condition
+const podPatchTimeout = 30 * time.Second
+
+// attachmentStatus the status of a network attachment as reported in the
+// networks status annotation
+type attachmentStatus struct {
+	State RunningState `json:"state"`
+	// LastOperation the last operation applied on the network attachment
+	LastOperation Optype `json:"lastOperation,omitempty"`
+	// LastError the error of the last operation, empty if it succeeded
+	LastError string `json:"lastError,omitempty"`
+	// Retries the number of times the last operation got retried after
+	// failing, it's reset once another operation is applied
+	Retries int `json:"retries,omitempty"`
+	// Timestamp when the last operation was applied
+	Timestamp *metav1.Time `json:"timestamp,omitempty"`
+}
+
+// statusUpdater rate-limits the writes of the Pods' networks status
+// annotation: the updates of a Pod's status are coalesced and written at
+// most once per interval
+type statusUpdater struct {
+	mu       sync.Mutex
+	interval time.Duration
+	write    func(podKey string)
+	stopped  bool
+	// pending the Pods whose status write is scheduled
+	pending map[string]bool
+	// lastWrite when the status of a Pod was last written
+	lastWrite map[string]time.Time
+	// attachments the status of the last operation on the Pods' network
+	// attachments, keyed by Pod key then network
+	attachments map[string]map[string]attachmentStatus
+}
+
+func newStatusUpdater(interval time.Duration, write func(podKey string)) *statusUpdater {
+	return &statusUpdater{
+		interval:    interval,
+		write:       write,
+		pending:     make(map[string]bool),
+		lastWrite:   make(map[string]time.Time),
+		attachments: make(map[string]map[string]attachmentStatus),
+	}
+}
+
+// setInterval sets the min interval between two writes of a Pod's status
+func (s *statusUpdater) setInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interval = interval
+}
+
+// record records the outcome err of the operation op on the network
+// attachment networkName of the Pod podKey
+func (s *statusUpdater) record(podKey, networkName string, op Optype, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses, ok := s.attachments[podKey]
+	if !ok {
+		statuses = make(map[string]attachmentStatus)
+		s.attachments[podKey] = statuses
+	}
+	prev := statuses[networkName]
+	now := metav1.Now()
+	status := attachmentStatus{LastOperation: op, Timestamp: &now}
+	if prev.LastOperation == op && prev.LastError != "" {
+		status.Retries = prev.Retries + 1
+	}
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	statuses[networkName] = status
+}
+
+// get returns the recorded status of the network attachments of the Pod podKey
+func (s *statusUpdater) get(podKey string) map[string]attachmentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make(map[string]attachmentStatus, len(s.attachments[podKey]))
+	for networkName, status := range s.attachments[podKey] {
+		statuses[networkName] = status
+	}
+	return statuses
+}
+
+// forget drops the recorded status of the Pod podKey
+func (s *statusUpdater) forget(podKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attachments, podKey)
+	delete(s.lastWrite, podKey)
+}
+
+// schedule schedules the write of the status of the Pod podKey, right away
+// unless it was written less than interval ago
+func (s *statusUpdater) schedule(podKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.pending[podKey] {
+		return
+	}
+	s.pending[podKey] = true
+	delay := time.Until(s.lastWrite[podKey].Add(s.interval))
+	if delay < 0 {
+		delay = 0
+	}
+	time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		delete(s.pending, podKey)
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		s.lastWrite[podKey] = time.Now()
+		s.mu.Unlock()
+		s.write(podKey)
+	})
+}
+
+// stop cancels the scheduled writes
+func (s *statusUpdater) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+}
+
+// recordAttachmentStatus records the outcome err of the operation op on a
+// network attachment, if op is set, and schedules the write of its Pod's
+// networks readiness gate condition and networks status annotation
+func (c *Controller) recordAttachmentStatus(attachmentTuple *cni.AttachmentTuple, op Optype, err error) {
+	key := c.configStore.getConfigRecordKey(attachmentTuple.Namespace, attachmentTuple.PodName, attachmentTuple.NetworkName)
+	cfgRecord, gerr := c.configStore.getConfigRecord(key)
+	if gerr != nil {
+		return
+	}
+	cniParams, perr := getCNIParams(cfgRecord.Expected.Data)
+	if perr != nil || cniParams.PodName == "" {
+		return
+	}
+	podKey := cniParams.Namespace + "/" + cniParams.PodName
+	if op != "" {
+		c.statuses.record(podKey, attachmentTuple.NetworkName, op, err)
+	}
+	c.statuses.schedule(podKey)
+}
+
+// writePodStatus writes the networks readiness gate condition and the
+// networks status annotation of the Pod podKey, see syncNetworksReady and
+// writeNetworksStatus
+func (c *Controller) writePodStatus(podKey string) {
+	namespace, podName, err := cache.SplitMetaNamespaceKey(podKey)
+	if err != nil {
+		return
+	}
+	pod, err := c.podLister.Pods(namespace).Get(podName)
+	if err != nil {
+		c.statuses.forget(podKey)
+		return
+	}
+	c.syncNetworksReady(pod)
+	c.writeNetworksStatus(pod)
+}
+
+// writeNetworksStatus writes the networks status annotation of the Pod,
+// when it's changed, off its ConfigStore records and the recorded status
+// of its network attachments. It's written with a merge patch that only
+// touches that annotation
+func (c *Controller) writeNetworksStatus(pod *apiv1.Pod) {
+	namespace, podName := pod.Namespace, pod.Name
+	podKey := namespace + "/" + podName
+	cfgRecords, err := c.getPodConfigRecords(namespace, podName)
+	if err != nil {
+		klog.ErrorS(err, "Failed to get Pod's config records", "pod", podKeyRef(podKey))
+		return
+	}
+
+	// the current annotation provides the status of the network
+	// attachments not operated on since the podagent started
+	curr, ok := pod.Annotations[networksStatusAnnotation]
+	prev := make(map[string]attachmentStatus)
+	if ok {
+		if err := json.Unmarshal([]byte(curr), &prev); err != nil {
+			klog.V(4).InfoS("Ignoring pod's invalid annotation", "pod", podKeyRef(podKey), "annotation", networksStatusAnnotation, "err", err)
+		}
+	}
+	recorded := c.statuses.get(podKey)
+	statuses := make(map[string]attachmentStatus)
+	for networkName, cfgRecord := range cfgRecords {
+		// the network attachments removed off the Pod's annotation are
+		// dropped once deleted, or if they never got added
+		if cfgRecord.Expected.Optype == Delete && (cfgRecord.Running.State == Nil || cfgRecord.Running.Data == nil) {
+			continue
+		}
+		status, ok := recorded[networkName]
+		if !ok {
+			status = prev[networkName]
+		}
+		status.State = cfgRecord.Running.State
+		if status.State == Failed && status.LastError == "" {
+			status.LastError = cfgRecord.Running.Reason
+		}
+		statuses[networkName] = status
+	}
+
+	var value interface{}
+	if len(statuses) > 0 {
+		data, err := json.Marshal(statuses)
+		if err != nil {
+			klog.ErrorS(err, "Failed to encode pod's networks status", "pod", podKeyRef(podKey))
+			return
+		}
+		if ok && curr == string(data) {
+			return
+		}
+		value = string(data)
+	} else if !ok {
+		return
+	}
+	// a null value removes the annotation
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{networksStatusAnnotation: value},
+		},
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to encode pod's networks status patch", "pod", podKeyRef(podKey))
+		return
+	}
+	klog.V(4).InfoS("Setting pod's annotation", "pod", podKeyRef(podKey), "annotation", networksStatusAnnotation, "value", value)
+	ctx, cancel := context.WithTimeout(context.Background(), podPatchTimeout)
+	defer cancel()
+	_, err = c.kubeClient.CoreV1().Pods(namespace).Patch(ctx, podName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		klog.ErrorS(err, "Failed to patch pod's annotation", "pod", podKeyRef(podKey), "annotation", networksStatusAnnotation)
+	}
+}
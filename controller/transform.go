@@ -0,0 +1,80 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podAnnotations the Pod annotations read by the podagent, the other ones
+// aren't cached
+var podAnnotations = []string{
+	networksAnnotation,
+	multusNetworksAnnotation,
+	networksStatusAnnotation,
+}
+
+// stripPod is the Pods informer's transform, it keeps only the Pod's
+// fields read by the podagent so that the Pods' cache doesn't hold their
+// specs, managed fields and such. Other objects (e.g. the tombstones of
+// deleted Pods) are returned as is
+func stripPod(obj interface{}) (interface{}, error) {
+	pod, ok := obj.(*apiv1.Pod)
+	if !ok {
+		return obj, nil
+	}
+	stripped := &apiv1.Pod{
+		TypeMeta: pod.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              pod.Name,
+			Namespace:         pod.Namespace,
+			UID:               pod.UID,
+			ResourceVersion:   pod.ResourceVersion,
+			DeletionTimestamp: pod.DeletionTimestamp,
+		},
+		Spec: apiv1.PodSpec{
+			NodeName:       pod.Spec.NodeName,
+			ReadinessGates: pod.Spec.ReadinessGates,
+		},
+		Status: apiv1.PodStatus{
+			Phase: pod.Status.Phase,
+		},
+	}
+	for _, name := range podAnnotations {
+		if value, ok := pod.Annotations[name]; ok {
+			if stripped.Annotations == nil {
+				stripped.Annotations = make(map[string]string, len(podAnnotations))
+			}
+			stripped.Annotations[name] = value
+		}
+	}
+	// the networks readiness gate condition is compared to the computed one
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == networksReadyCondition {
+			stripped.Status.Conditions = []apiv1.PodCondition{cond}
+		}
+	}
+	// the sandbox is resolved off the first container's ID
+	if len(pod.Status.ContainerStatuses) > 0 {
+		stripped.Status.ContainerStatuses = []apiv1.ContainerStatus{{
+			Name:        pod.Status.ContainerStatuses[0].Name,
+			ContainerID: pod.Status.ContainerStatuses[0].ContainerID,
+		}}
+	}
+	return stripped, nil
+}
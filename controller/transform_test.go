@@ -0,0 +1,197 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// benchmarkPods the number of Pods of the Pods' cache benchmark, i.e. a
+// dense node
+const benchmarkPods = 500
+
+// newBenchmarkPod returns a Pod as typically found on a node: a couple of
+// containers with env and mounts, managed fields and a last applied
+// configuration annotation
+func newBenchmarkPod(i int) *apiv1.Pod {
+	name := fmt.Sprintf("vnf-%d", i)
+	var env []apiv1.EnvVar
+	for j := 0; j < 20; j++ {
+		env = append(env, apiv1.EnvVar{Name: fmt.Sprintf("ENV_VAR_%d", j), Value: strings.Repeat("v", 32)})
+	}
+	container := func(name string) apiv1.Container {
+		return apiv1.Container{
+			Name:    name,
+			Image:   "registry.example.com/vnf/" + name + ":1.2.3",
+			Command: []string{"/usr/bin/" + name, "--config", "/etc/" + name + "/config.yaml"},
+			Env:     env,
+			Resources: apiv1.ResourceRequirements{
+				Limits:   apiv1.ResourceList{apiv1.ResourceMemory: resource.MustParse("256Mi"), apiv1.ResourceCPU: resource.MustParse("500m")},
+				Requests: apiv1.ResourceList{apiv1.ResourceMemory: resource.MustParse("128Mi"), apiv1.ResourceCPU: resource.MustParse("100m")},
+			},
+			VolumeMounts: []apiv1.VolumeMount{
+				{Name: "config", MountPath: "/etc/" + name},
+				{Name: "kube-api-access", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount", ReadOnly: true},
+			},
+		}
+	}
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			UID:             types.UID(fmt.Sprintf("uid-%d", i)),
+			ResourceVersion: fmt.Sprintf("%d", 1000+i),
+			Labels:          map[string]string{"app": "vnf", "pod-template-hash": "5d4f8b7c9"},
+			Annotations: map[string]string{
+				networksAnnotation: `[{"name":"green"},{"name":"red","interface":"data0"}]`,
+				"kubectl.kubernetes.io/last-applied-configuration": strings.Repeat("x", 3000),
+			},
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "vnf-5d4f8b7c9", UID: "rs-uid"}},
+			ManagedFields: []metav1.ManagedFieldsEntry{
+				{Manager: "kube-controller-manager", Operation: metav1.ManagedFieldsOperationUpdate, FieldsType: "FieldsV1",
+					FieldsV1: &metav1.FieldsV1{Raw: []byte(strings.Repeat("f", 2000))}},
+				{Manager: "kubelet", Operation: metav1.ManagedFieldsOperationUpdate, FieldsType: "FieldsV1", Subresource: "status",
+					FieldsV1: &metav1.FieldsV1{Raw: []byte(strings.Repeat("f", 1500))}},
+			},
+		},
+		Spec: apiv1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []apiv1.Container{container("vnf"), container("sidecar")},
+			Volumes: []apiv1.Volume{
+				{Name: "config", VolumeSource: apiv1.VolumeSource{ConfigMap: &apiv1.ConfigMapVolumeSource{LocalObjectReference: apiv1.LocalObjectReference{Name: "vnf-config"}}}},
+			},
+			Tolerations: []apiv1.Toleration{
+				{Key: "node.kubernetes.io/not-ready", Operator: apiv1.TolerationOpExists, Effect: apiv1.TaintEffectNoExecute},
+				{Key: "node.kubernetes.io/unreachable", Operator: apiv1.TolerationOpExists, Effect: apiv1.TaintEffectNoExecute},
+			},
+		},
+		Status: apiv1.PodStatus{
+			Phase: apiv1.PodRunning,
+			Conditions: []apiv1.PodCondition{
+				{Type: apiv1.PodInitialized, Status: apiv1.ConditionTrue},
+				{Type: apiv1.PodReady, Status: apiv1.ConditionTrue},
+				{Type: apiv1.ContainersReady, Status: apiv1.ConditionTrue},
+				{Type: apiv1.PodScheduled, Status: apiv1.ConditionTrue},
+			},
+			HostIP: "10.0.0.1",
+			PodIP:  fmt.Sprintf("10.244.%d.%d", i/250, i%250),
+			ContainerStatuses: []apiv1.ContainerStatus{
+				{Name: "vnf", Ready: true, Image: "registry.example.com/vnf/vnf:1.2.3", ImageID: "sha256:" + strings.Repeat("a", 64), ContainerID: fmt.Sprintf("cri-o://c%d", i)},
+				{Name: "sidecar", Ready: true, Image: "registry.example.com/vnf/sidecar:1.2.3", ImageID: "sha256:" + strings.Repeat("b", 64), ContainerID: fmt.Sprintf("cri-o://s%d", i)},
+			},
+		},
+	}
+}
+
+func TestStripPod(t *testing.T) {
+	pod := newBenchmarkPod(1)
+	pod.Spec.ReadinessGates = []apiv1.PodReadinessGate{{ConditionType: networksReadyCondition}}
+	pod.Status.Conditions = append(pod.Status.Conditions, apiv1.PodCondition{Type: networksReadyCondition, Status: apiv1.ConditionTrue})
+
+	obj, err := stripPod(pod)
+	if err != nil {
+		t.Fatalf("Failed to strip pod: %v", err)
+	}
+	stripped := obj.(*apiv1.Pod)
+	want := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+			Annotations:     map[string]string{networksAnnotation: pod.Annotations[networksAnnotation]},
+		},
+		Spec: apiv1.PodSpec{
+			NodeName:       pod.Spec.NodeName,
+			ReadinessGates: pod.Spec.ReadinessGates,
+		},
+		Status: apiv1.PodStatus{
+			Phase:             apiv1.PodRunning,
+			Conditions:        []apiv1.PodCondition{{Type: networksReadyCondition, Status: apiv1.ConditionTrue}},
+			ContainerStatuses: []apiv1.ContainerStatus{{Name: "vnf", ContainerID: "cri-o://c1"}},
+		},
+	}
+	if !reflect.DeepEqual(stripped, want) {
+		t.Fatalf("Unexpected stripped pod:\n got: %+v\nwant: %+v", stripped, want)
+	}
+
+	// the tombstones of the deleted Pods are kept as is
+	tombstone := cache.DeletedFinalStateUnknown{Key: "default/vnf-1", Obj: pod}
+	if obj, _ := stripPod(tombstone); !reflect.DeepEqual(obj, tombstone) {
+		t.Fatalf("Unexpected stripped tombstone: %+v", obj)
+	}
+}
+
+// benchmarkPodsCache reports the heap held by a cache of benchmarkPods Pods
+// stored through transform, if any
+func benchmarkPodsCache(b *testing.B, transform cache.TransformFunc) {
+	var ms runtime.MemStats
+	var heap int64
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		before := ms.HeapAlloc
+		b.StartTimer()
+
+		store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+		for i := 0; i < benchmarkPods; i++ {
+			// a Pod as decoded off a watch event
+			var obj interface{} = newBenchmarkPod(i)
+			if transform != nil {
+				var err error
+				if obj, err = transform(obj); err != nil {
+					b.Fatalf("Failed to transform pod: %v", err)
+				}
+			}
+			if err := store.Add(obj); err != nil {
+				b.Fatalf("Failed to add pod: %v", err)
+			}
+		}
+
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		heap += int64(ms.HeapAlloc) - int64(before)
+		runtime.KeepAlive(store)
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(heap)/float64(b.N), "heap-bytes/op")
+	b.ReportMetric(float64(heap)/float64(b.N)/benchmarkPods, "heap-bytes/pod")
+}
+
+// BenchmarkPodsCache compares the heap held by the Pods' cache with and
+// without the stripPod transform, e.g.:
+// go test -run ^$ -bench PodsCache ./controller/
+func BenchmarkPodsCache(b *testing.B) {
+	b.Run("full", func(b *testing.B) {
+		benchmarkPodsCache(b, nil)
+	})
+	b.Run("stripped", func(b *testing.B) {
+		benchmarkPodsCache(b, stripPod)
+	})
+}
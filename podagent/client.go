@@ -19,12 +19,13 @@ package main
 import (
 	"fmt"
 
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func createClient(kubeconfig string) (*kubernetes.Clientset, error) {
+func createConfig(kubeconfig string) (*rest.Config, error) {
 	var err error
 
 	cfg := &rest.Config{}
@@ -41,7 +42,15 @@ func createClient(kubeconfig string) (*kubernetes.Clientset, error) {
 			return nil, fmt.Errorf("couldn't initialize InClusterConfig %v", err)
 		}
 	}
+	return cfg, nil
+}
 
+func createClient(cfg *rest.Config) (*kubernetes.Clientset, error) {
 	// creates the clientset
 	return kubernetes.NewForConfig(cfg)
 }
+
+func createDynamicClient(cfg *rest.Config) (dynamic.Interface, error) {
+	// creates the dynamic client, used for the network custom resources
+	return dynamic.NewForConfig(cfg)
+}
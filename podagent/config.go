@@ -0,0 +1,393 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// configAPIVersion the version of the configuration file's schema
+	configAPIVersion = "podagent.kaloom.com/v1alpha1"
+	configKind       = "PodagentConfiguration"
+)
+
+// reloadableFlags the flags whose setting is applied on SIGHUP, the other
+// ones require a restart
+var reloadableFlags = map[string]bool{
+	"v":                   true,
+	"status-interval":     true,
+	"retry-initial-delay": true,
+	"retry-max-delay":     true,
+}
+
+// podagentConfig the podagent's configuration file (-config), in YAML or
+// JSON. Every setting is optional, an unset one keeps its flag's default
+// and a flag set on the command line overrides the file's setting
+type podagentConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	Runtime runtimeConfig `json:"runtime,omitempty"`
+	CNI     cniConfig     `json:"cni,omitempty"`
+	// StoreDir the directory of the network attachments' records
+	StoreDir string `json:"storeDir,omitempty"`
+	// Workers the number of workers processing the events, only 1 is
+	// supported (see Controller.Process)
+	Workers        *int             `json:"workers,omitempty"`
+	Retry          retryConfig      `json:"retry,omitempty"`
+	ResyncPeriod   *metav1.Duration `json:"resyncPeriod,omitempty"`
+	CheckPeriod    *metav1.Duration `json:"checkPeriod,omitempty"`
+	StatusInterval *metav1.Duration `json:"statusInterval,omitempty"`
+	Selector       selectorConfig   `json:"selector,omitempty"`
+	Kubelet        kubeletConfig    `json:"kubelet,omitempty"`
+	// HealthAddress the address of /healthz and /readyz
+	HealthAddress string `json:"healthAddress,omitempty"`
+	// DebugAddress the address of /debug/flags/v
+	DebugAddress string `json:"debugAddress,omitempty"`
+	// MetricsAddress the address of /metrics
+	MetricsAddress string        `json:"metricsAddress,omitempty"`
+	Logging        loggingConfig `json:"logging,omitempty"`
+}
+
+type runtimeConfig struct {
+	// Type either crio or docker
+	Type           string `json:"type,omitempty"`
+	CrioEndpoint   string `json:"crioEndpoint,omitempty"`
+	DockerEndpoint string `json:"dockerEndpoint,omitempty"`
+}
+
+type cniConfig struct {
+	BinPath        string           `json:"binPath,omitempty"`
+	ConfPath       string           `json:"confPath,omitempty"`
+	Vendor         string           `json:"vendor,omitempty"`
+	Timeout        *metav1.Duration `json:"timeout,omitempty"`
+	DirectDelegate *bool            `json:"directDelegate,omitempty"`
+	Nsenter        *bool            `json:"nsenter,omitempty"`
+}
+
+type retryConfig struct {
+	// InitialDelay the delay before the first retry of a network
+	// attachment, doubled on every consecutive failure up to MaxDelay
+	InitialDelay *metav1.Duration `json:"initialDelay,omitempty"`
+	MaxDelay     *metav1.Duration `json:"maxDelay,omitempty"`
+}
+
+type selectorConfig struct {
+	PodSelector       string   `json:"podSelector,omitempty"`
+	Namespaces        []string `json:"namespaces,omitempty"`
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+}
+
+type kubeletConfig struct {
+	URL                   string           `json:"url,omitempty"`
+	PollPeriod            *metav1.Duration `json:"pollPeriod,omitempty"`
+	TokenFile             string           `json:"tokenFile,omitempty"`
+	CAFile                string           `json:"caFile,omitempty"`
+	InsecureSkipTLSVerify *bool            `json:"insecureSkipTLSVerify,omitempty"`
+}
+
+type loggingConfig struct {
+	// Format either text or json
+	Format    string `json:"format,omitempty"`
+	Verbosity *int   `json:"verbosity,omitempty"`
+}
+
+// configSetting a setting of the configuration file along with the flag
+// it sets
+type configSetting struct {
+	path  string
+	flag  string
+	value string
+}
+
+// loadConfig reads and validates the configuration file path, the unknown
+// and duplicated fields are rejected
+func loadConfig(path string) (*podagentConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the config file: %w", err)
+	}
+	cfg := &podagentConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	if errs := cfg.validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, errs.ToAggregate())
+	}
+	return cfg, nil
+}
+
+// validate returns the invalid settings of the configuration
+func (c *podagentConfig) validate() field.ErrorList {
+	var errs field.ErrorList
+	if c.APIVersion != configAPIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{configAPIVersion}))
+	}
+	if c.Kind != configKind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{configKind}))
+	}
+
+	runtimePath := field.NewPath("runtime")
+	if c.Runtime.Type != "" && c.Runtime.Type != "crio" && c.Runtime.Type != "docker" {
+		errs = append(errs, field.NotSupported(runtimePath.Child("type"), c.Runtime.Type, []string{"crio", "docker"}))
+	}
+	errs = append(errs, validateEndpoint(runtimePath.Child("crioEndpoint"), c.Runtime.CrioEndpoint)...)
+	errs = append(errs, validateEndpoint(runtimePath.Child("dockerEndpoint"), c.Runtime.DockerEndpoint)...)
+
+	cniPath := field.NewPath("cni")
+	errs = append(errs, validateAbsPath(cniPath.Child("binPath"), c.CNI.BinPath)...)
+	errs = append(errs, validateAbsPath(cniPath.Child("confPath"), c.CNI.ConfPath)...)
+	errs = append(errs, validateDuration(cniPath.Child("timeout"), c.CNI.Timeout, false)...)
+	errs = append(errs, validateAbsPath(field.NewPath("storeDir"), c.StoreDir)...)
+	if c.Workers != nil && *c.Workers != 1 {
+		errs = append(errs, field.Invalid(field.NewPath("workers"), *c.Workers,
+			"only 1 worker is supported, the events are processed by a single worker so that the operations on a network attachment never interleave"))
+	}
+
+	retryPath := field.NewPath("retry")
+	errs = append(errs, validateDuration(retryPath.Child("initialDelay"), c.Retry.InitialDelay, true)...)
+	errs = append(errs, validateDuration(retryPath.Child("maxDelay"), c.Retry.MaxDelay, true)...)
+	if c.Retry.InitialDelay != nil && c.Retry.MaxDelay != nil && c.Retry.InitialDelay.Duration > c.Retry.MaxDelay.Duration {
+		errs = append(errs, field.Invalid(retryPath.Child("initialDelay"), c.Retry.InitialDelay.Duration.String(),
+			"must not be greater than retry.maxDelay"))
+	}
+	errs = append(errs, validateDuration(field.NewPath("resyncPeriod"), c.ResyncPeriod, true)...)
+	errs = append(errs, validateDuration(field.NewPath("checkPeriod"), c.CheckPeriod, false)...)
+	errs = append(errs, validateDuration(field.NewPath("statusInterval"), c.StatusInterval, false)...)
+
+	selectorPath := field.NewPath("selector")
+	if _, err := labels.Parse(c.Selector.PodSelector); err != nil {
+		errs = append(errs, field.Invalid(selectorPath.Child("podSelector"), c.Selector.PodSelector, err.Error()))
+	}
+	errs = append(errs, validateNamespaces(selectorPath.Child("namespaces"), c.Selector.Namespaces)...)
+	errs = append(errs, validateNamespaces(selectorPath.Child("excludeNamespaces"), c.Selector.ExcludeNamespaces)...)
+
+	kubeletPath := field.NewPath("kubelet")
+	if c.Kubelet.URL != "" {
+		if u, err := url.Parse(c.Kubelet.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, field.Invalid(kubeletPath.Child("url"), c.Kubelet.URL, "must be an http:// or https:// url"))
+		}
+	}
+	errs = append(errs, validateDuration(kubeletPath.Child("pollPeriod"), c.Kubelet.PollPeriod, true)...)
+	errs = append(errs, validateAbsPath(kubeletPath.Child("tokenFile"), c.Kubelet.TokenFile)...)
+	errs = append(errs, validateAbsPath(kubeletPath.Child("caFile"), c.Kubelet.CAFile)...)
+
+	errs = append(errs, validateAddress(field.NewPath("healthAddress"), c.HealthAddress)...)
+	errs = append(errs, validateAddress(field.NewPath("debugAddress"), c.DebugAddress)...)
+	errs = append(errs, validateAddress(field.NewPath("metricsAddress"), c.MetricsAddress)...)
+	loggingPath := field.NewPath("logging")
+	if c.Logging.Format != "" && c.Logging.Format != textLogFormat && c.Logging.Format != jsonLogFormat {
+		errs = append(errs, field.NotSupported(loggingPath.Child("format"), c.Logging.Format, []string{textLogFormat, jsonLogFormat}))
+	}
+	if c.Logging.Verbosity != nil && *c.Logging.Verbosity < 0 {
+		errs = append(errs, field.Invalid(loggingPath.Child("verbosity"), *c.Logging.Verbosity, "must not be negative"))
+	}
+	return errs
+}
+
+// validateEndpoint validates the container runtime endpoint, if set
+func validateEndpoint(fldPath *field.Path, endpoint string) field.ErrorList {
+	if endpoint == "" {
+		return nil
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "unix" && u.Scheme != "tcp") {
+		return field.ErrorList{field.Invalid(fldPath, endpoint, "must be a unix:// or tcp:// endpoint")}
+	}
+	return nil
+}
+
+// validateAddress validates the listening address, if set
+func validateAddress(fldPath *field.Path, address string) field.ErrorList {
+	if address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, address, err.Error())}
+	}
+	return nil
+}
+
+// validateAbsPath validates that path, if set, is absolute
+func validateAbsPath(fldPath *field.Path, path string) field.ErrorList {
+	if path != "" && !filepath.IsAbs(path) {
+		return field.ErrorList{field.Invalid(fldPath, path, "must be an absolute path")}
+	}
+	return nil
+}
+
+// validateDuration validates that d, if set, isn't negative nor zero if
+// positive is set
+func validateDuration(fldPath *field.Path, d *metav1.Duration, positive bool) field.ErrorList {
+	switch {
+	case d == nil:
+	case positive && d.Duration <= 0:
+		return field.ErrorList{field.Invalid(fldPath, d.Duration.String(), "must be greater than 0")}
+	case d.Duration < 0:
+		return field.ErrorList{field.Invalid(fldPath, d.Duration.String(), "must not be negative")}
+	}
+	return nil
+}
+
+// validateNamespaces validates that namespaces are namespace names
+func validateNamespaces(fldPath *field.Path, namespaces []string) field.ErrorList {
+	var errs field.ErrorList
+	for i, ns := range namespaces {
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			errs = append(errs, field.Invalid(fldPath.Index(i), ns, msg))
+		}
+	}
+	return errs
+}
+
+// settings returns the settings of the configuration, the unset ones
+// aren't returned
+func (c *podagentConfig) settings() []configSetting {
+	var settings []configSetting
+	add := func(path, flag, value string) {
+		if value != "" {
+			settings = append(settings, configSetting{path: path, flag: flag, value: value})
+		}
+	}
+	duration := func(d *metav1.Duration) string {
+		if d == nil {
+			return ""
+		}
+		return d.Duration.String()
+	}
+	boolean := func(b *bool) string {
+		if b == nil {
+			return ""
+		}
+		return strconv.FormatBool(*b)
+	}
+	integer := func(i *int) string {
+		if i == nil {
+			return ""
+		}
+		return strconv.Itoa(*i)
+	}
+	add("runtime.type", "container-type", c.Runtime.Type)
+	add("runtime.crioEndpoint", "crio-endpoint", c.Runtime.CrioEndpoint)
+	add("runtime.dockerEndpoint", "docker-endpoint", c.Runtime.DockerEndpoint)
+	add("cni.binPath", "cni-bin-path", c.CNI.BinPath)
+	add("cni.confPath", "cni-conf-path", c.CNI.ConfPath)
+	add("cni.vendor", "cni-vendor-name", c.CNI.Vendor)
+	add("cni.timeout", "cni-timeout", duration(c.CNI.Timeout))
+	add("cni.directDelegate", "direct-delegate", boolean(c.CNI.DirectDelegate))
+	add("cni.nsenter", "nsenter", boolean(c.CNI.Nsenter))
+	add("storeDir", "store-dir", c.StoreDir)
+	add("retry.initialDelay", "retry-initial-delay", duration(c.Retry.InitialDelay))
+	add("retry.maxDelay", "retry-max-delay", duration(c.Retry.MaxDelay))
+	add("resyncPeriod", "resync-period", duration(c.ResyncPeriod))
+	add("checkPeriod", "check-period", duration(c.CheckPeriod))
+	add("statusInterval", "status-interval", duration(c.StatusInterval))
+	add("selector.podSelector", "pod-selector", c.Selector.PodSelector)
+	add("selector.namespaces", "namespaces", strings.Join(c.Selector.Namespaces, ","))
+	add("selector.excludeNamespaces", "exclude-namespaces", strings.Join(c.Selector.ExcludeNamespaces, ","))
+	add("kubelet.url", "kubelet-url", c.Kubelet.URL)
+	add("kubelet.pollPeriod", "kubelet-poll-period", duration(c.Kubelet.PollPeriod))
+	add("kubelet.tokenFile", "kubelet-token-file", c.Kubelet.TokenFile)
+	add("kubelet.caFile", "kubelet-ca-file", c.Kubelet.CAFile)
+	add("kubelet.insecureSkipTLSVerify", "kubelet-insecure-skip-tls-verify", boolean(c.Kubelet.InsecureSkipTLSVerify))
+	add("healthAddress", "health-address", c.HealthAddress)
+	add("debugAddress", "debug-address", c.DebugAddress)
+	add("metricsAddress", "metrics-address", c.MetricsAddress)
+	add("logging.format", "log-format", c.Logging.Format)
+	add("logging.verbosity", "v", integer(c.Logging.Verbosity))
+	return settings
+}
+
+// applyConfig sets the flags of fs off the settings of cfg, but the ones
+// set on the command line, i.e. in explicit
+func applyConfig(fs *flag.FlagSet, cfg *podagentConfig, explicit map[string]bool) error {
+	for _, s := range cfg.settings() {
+		if explicit[s.flag] {
+			continue
+		}
+		if err := fs.Set(s.flag, s.value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", s.path, s.value, err)
+		}
+	}
+	return nil
+}
+
+// reloadConfig sets the reloadable flags of fs off the settings of next
+// that changed since prev, a changed setting that requires a restart or is
+// overridden by its flag is ignored. It returns true if a flag got set
+func reloadConfig(fs *flag.FlagSet, prev, next *podagentConfig, explicit map[string]bool) (bool, error) {
+	prevValues := make(map[string]string)
+	for _, s := range prev.settings() {
+		prevValues[s.flag] = s.value
+	}
+	nextSettings := make(map[string]configSetting)
+	for _, s := range next.settings() {
+		nextSettings[s.flag] = s
+	}
+	// the settings removed off the file get their flag's default back
+	for _, s := range prev.settings() {
+		if _, ok := nextSettings[s.flag]; !ok {
+			nextSettings[s.flag] = configSetting{path: s.path, flag: s.flag, value: fs.Lookup(s.flag).DefValue}
+		}
+	}
+
+	// on an invalid setting, the ones already set get their previous value back
+	applied := make(map[string]string)
+	rollback := func() {
+		for name, value := range applied {
+			fs.Set(name, value)
+		}
+	}
+	for _, s := range nextSettings {
+		if prevValues[s.flag] == s.value {
+			continue
+		}
+		switch {
+		case explicit[s.flag]:
+			klog.InfoS("Ignoring changed setting overridden by its flag", "setting", s.path, "flag", s.flag)
+		case !reloadableFlags[s.flag]:
+			klog.InfoS("Ignoring changed setting, it requires a restart", "setting", s.path, "value", s.value)
+		default:
+			prevValue := fs.Lookup(s.flag).Value.String()
+			if err := fs.Set(s.flag, s.value); err != nil {
+				rollback()
+				return false, fmt.Errorf("invalid %s %q: %v", s.path, s.value, err)
+			}
+			applied[s.flag] = prevValue
+		}
+	}
+	for _, s := range nextSettings {
+		if _, ok := applied[s.flag]; ok {
+			klog.InfoS("Reloaded setting", "setting", s.path, "value", s.value)
+		}
+	}
+	return len(applied) > 0, nil
+}
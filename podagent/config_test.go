@@ -0,0 +1,244 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes data to a configuration file and returns its path
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// newTestFlagSet returns a flag set with a few of the podagent's flags
+func newTestFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("podagent", flag.ContinueOnError)
+	fs.String("container-type", "docker", "")
+	fs.String("cni-bin-path", "/opt/cni/bin", "")
+	fs.Duration("resync-period", 5*time.Minute, "")
+	fs.Duration("status-interval", 5*time.Second, "")
+	fs.Duration("retry-initial-delay", time.Second, "")
+	fs.Duration("retry-max-delay", 5*time.Minute, "")
+	fs.String("namespaces", "", "")
+	return fs
+}
+
+func TestLoadConfig(t *testing.T) {
+	yamlConfig := writeConfig(t, "podagent.yaml", `
+apiVersion: podagent.kaloom.com/v1alpha1
+kind: PodagentConfiguration
+runtime:
+  type: crio
+cni:
+  binPath: /usr/libexec/cni
+resyncPeriod: 10m
+retry:
+  initialDelay: 2s
+selector:
+  namespaces: [vnf, "edge"]
+`)
+	jsonConfig := writeConfig(t, "podagent.json", `{
+  "apiVersion": "podagent.kaloom.com/v1alpha1",
+  "kind": "PodagentConfiguration",
+  "runtime": {"type": "crio"},
+  "cni": {"binPath": "/usr/libexec/cni"},
+  "resyncPeriod": "10m",
+  "retry": {"initialDelay": "2s"},
+  "selector": {"namespaces": ["vnf", "edge"]}
+}`)
+	for _, path := range []string{yamlConfig, jsonConfig} {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", path, err)
+		}
+		fs := newTestFlagSet()
+		// the flags set on the command line override the file
+		if err := fs.Parse([]string{"-resync-period", "1m"}); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		if err := applyConfig(fs, cfg, map[string]bool{"resync-period": true}); err != nil {
+			t.Fatalf("Failed to apply %s: %v", path, err)
+		}
+		for name, want := range map[string]string{
+			"container-type":      "crio",
+			"cni-bin-path":        "/usr/libexec/cni",
+			"resync-period":       "1m0s",
+			"retry-initial-delay": "2s",
+			"retry-max-delay":     "5m0s",
+			"namespaces":          "vnf,edge",
+		} {
+			if got := fs.Lookup(name).Value.String(); got != want {
+				t.Errorf("%s: unexpected -%s %q, want %q", path, name, got, want)
+			}
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		errs   []string
+	}{
+		{
+			config: "apiVersion: podagent.kaloom.com/v1\nkind: PodagentConfiguration\n",
+			errs:   []string{`apiVersion: Unsupported value: "podagent.kaloom.com/v1"`},
+		},
+		{
+			config: "apiVersion: podagent.kaloom.com/v1alpha1\nkind: PodagentConfiguration\nstoreDirectory: /var/run/podagent\n",
+			errs:   []string{`unknown field "storeDirectory"`},
+		},
+		{
+			config: "apiVersion: podagent.kaloom.com/v1alpha1\nkind: PodagentConfiguration\ncni:\n  nsenter: maybe\n",
+			errs:   []string{"cannot unmarshal string"},
+		},
+		{
+			config: `
+apiVersion: podagent.kaloom.com/v1alpha1
+kind: PodagentConfiguration
+runtime:
+  type: containerd
+  crioEndpoint: /var/run/crio/crio.sock
+cni:
+  confPath: etc/cni/net.d
+retry:
+  initialDelay: 10m
+  maxDelay: 5m
+selector:
+  podSelector: "managed in (true"
+  namespaces: [Default]
+workers: 4
+debugAddress: "9441"
+metricsAddress: localhost
+logging:
+  format: xml
+`,
+			errs: []string{
+				`runtime.type: Unsupported value: "containerd"`,
+				`runtime.crioEndpoint: Invalid value: "/var/run/crio/crio.sock": must be a unix:// or tcp:// endpoint`,
+				`cni.confPath: Invalid value: "etc/cni/net.d": must be an absolute path`,
+				`retry.initialDelay: Invalid value: "10m0s": must not be greater than retry.maxDelay`,
+				`selector.podSelector: Invalid value: "managed in (true"`,
+				`selector.namespaces[0]: Invalid value: "Default"`,
+				`workers: Invalid value: 4: only 1 worker is supported`,
+				`debugAddress: Invalid value: "9441"`,
+				`metricsAddress: Invalid value: "localhost"`,
+				`logging.format: Unsupported value: "xml"`,
+			},
+		},
+	} {
+		_, err := loadConfig(writeConfig(t, "podagent.yaml", tc.config))
+		if err == nil {
+			t.Errorf("Expected an error for the config:\n%s", tc.config)
+			continue
+		}
+		for _, want := range tc.errs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Expected error %q, got: %v", want, err)
+			}
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	const header = "apiVersion: podagent.kaloom.com/v1alpha1\nkind: PodagentConfiguration\n"
+	prev, err := loadConfig(writeConfig(t, "podagent.yaml", header+`
+statusInterval: 10s
+resyncPeriod: 10m
+retry:
+  maxDelay: 1m
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	next, err := loadConfig(writeConfig(t, "podagent.yaml", header+`
+statusInterval: 1s
+resyncPeriod: 20m
+retry:
+  initialDelay: 500ms
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	fs := newTestFlagSet()
+	explicit := map[string]bool{"retry-initial-delay": true}
+	if err := applyConfig(fs, prev, explicit); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	reloaded, err := reloadConfig(fs, prev, next, explicit)
+	if err != nil || !reloaded {
+		t.Fatalf("Unexpected reload: %v, %v", reloaded, err)
+	}
+	for name, want := range map[string]string{
+		// reloaded
+		"status-interval": "1s",
+		// not reloadable
+		"resync-period": "10m0s",
+		// overridden by its flag
+		"retry-initial-delay": "1s",
+		// removed off the file
+		"retry-max-delay": "5m0s",
+	} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("Unexpected -%s %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReloadConfigInvalidSetting(t *testing.T) {
+	const header = "apiVersion: podagent.kaloom.com/v1alpha1\nkind: PodagentConfiguration\n"
+	prev, err := loadConfig(writeConfig(t, "podagent.yaml", header+"statusInterval: 10s\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	next, err := loadConfig(writeConfig(t, "podagent.yaml", header+`
+statusInterval: 1s
+logging:
+  verbosity: 3
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	fs := newTestFlagSet()
+	fs.Func("v", "", func(string) error {
+		return fmt.Errorf("rejected")
+	})
+	if err := applyConfig(fs, prev, map[string]bool{}); err != nil {
+		t.Fatalf("Failed to apply config: %v", err)
+	}
+	reloaded, err := reloadConfig(fs, prev, next, map[string]bool{})
+	if err == nil || reloaded {
+		t.Fatalf("Expected a failed reload, got: %v, %v", reloaded, err)
+	}
+	// the settings already set are restored
+	if got := fs.Lookup("status-interval").Value.String(); got != "10s" {
+		t.Errorf("Unexpected -status-interval %q, want %q", got, "10s")
+	}
+}
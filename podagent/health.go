@@ -0,0 +1,96 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// serveHealth serves the liveness (/healthz) and the readiness (/readyz)
+// endpoints on address, the podagent is ready when ready returns no error
+func serveHealth(address string, ready func() error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	klog.InfoS("Serving health endpoints", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.ErrorS(err, "Failed to serve health endpoints", "address", address)
+	}
+}
+
+// serveDebug serves the logs verbosity on /debug/flags/v on address, it's
+// unauthenticated hence kept apart from the health endpoints that the
+// kubelet probes
+func serveDebug(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/flags/v", serveVerbosity)
+	klog.InfoS("Serving debug endpoints", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.ErrorS(err, "Failed to serve debug endpoints", "address", address)
+	}
+}
+
+// serveMetrics serves the Prometheus metrics on /metrics on address
+func serveMetrics(address string, metrics http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	klog.InfoS("Serving metrics", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.ErrorS(err, "Failed to serve metrics", "address", address)
+	}
+}
+
+// serveVerbosity returns the logs verbosity (-v) on a GET and sets it off
+// the request's body on a PUT, e.g.:
+// curl -X PUT -d 5 http://127.0.0.1:9441/debug/flags/v
+func serveVerbosity(w http.ResponseWriter, r *http.Request) {
+	v := flag.Lookup("v")
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, v.Value.String())
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level := strings.TrimSpace(string(body))
+		if err := v.Value.Set(level); err != nil {
+			http.Error(w, fmt.Sprintf("invalid verbosity %q: %v", level, err), http.StatusBadRequest)
+			return
+		}
+		klog.InfoS("Logs verbosity changed", "v", level)
+		fmt.Fprintf(w, "successfully set klog.logging.verbosity to %s\n", level)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2017-2023 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+
+	"github.com/go-logr/logr/slogr"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// textLogFormat klog's own key=value text format
+	textLogFormat = "text"
+	// jsonLogFormat one JSON object per log entry
+	jsonLogFormat = "json"
+)
+
+// setupLogging sets the format of the logs, either textLogFormat or
+// jsonLogFormat
+func setupLogging(format string) error {
+	switch format {
+	case textLogFormat:
+		return nil
+	case jsonLogFormat:
+		// the verbosity is filtered by klog (i.e. -v) ahead of the handler,
+		// which then logs every entry it gets
+		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.Level(math.MinInt)})
+		klog.SetLogger(slogr.NewLogr(handler))
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q, either %s or %s", format, textLogFormat, jsonLogFormat)
+	}
+}
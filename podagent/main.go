@@ -19,10 +19,15 @@ import (
 	"context"
 	"flag"
 	"fmt"
-
-	"github.com/golang/glog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/kaloom/kubernetes-podagent/controller"
+
+	"k8s.io/klog/v2"
 )
 
 var (
@@ -35,7 +40,21 @@ func showBuildDetails() {
 	fmt.Printf("podagent build details, branch/tag: %s, commit: %s, date: %s\n", branch, commit, date)
 }
 
+// splitList returns the elements of a comma-separated list
+func splitList(list string) []string {
+	var elems []string
+	for _, elem := range strings.Split(list, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
+
 func main() {
+	// klog's flags, e.g. -v and -logtostderr
+	klog.InitFlags(nil)
+	defer klog.Flush()
 
 	kubeconfig := flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	nodeName := flag.String("node", "", "kubernetes node name")
@@ -45,6 +64,29 @@ func main() {
 	cniConfPath := flag.String("cni-conf-path", "/etc/cni/net.d", "cni plugin network configuration path")
 	cniVendorName := flag.String("cni-vendor-name", "", "cni vendor name (default \"\", i.e. use the cni-plugin type found off the first lexical config in /etc/cni/net.d)")
 	containerTypeArg := flag.String("container-type", "docker", "container type (either crio or docker)")
+	resyncPeriod := flag.Duration("resync-period", 5*time.Minute, "period of the full reconciliation of the pods network attachments")
+	checkPeriod := flag.Duration("check-period", 5*time.Minute, "period of the cni CHECK of the active network attachments, 0 to disable it")
+	cniTimeout := flag.Duration("cni-timeout", time.Minute, "timeout of a cni-plugin invocation, the cni-plugin and the processes it spawned get killed once expired, 0 to disable it")
+	directDelegate := flag.Bool("direct-delegate", false, "invoke the cni-plugin of a network directly off its kaloom.com/v1 Network resource spec.config instead of through the default cni config (i.e. kactus)")
+	useNsenter := flag.Bool("nsenter", false, "run the cni-plugins through nsenter in the mount and network namespaces of the host's PID 1 (requires sharing the host's pid namespace), -cni-bin-path and the vendor's cni bin directory are then looked up on the host")
+	storeDir := flag.String("store-dir", "/var/run/podagent/configstore/", "directory of the network attachments' records")
+	retryInitialDelay := flag.Duration("retry-initial-delay", time.Second, "delay before retrying a network attachment failing with a transient error, doubled on every consecutive failure up to -retry-max-delay")
+	retryMaxDelay := flag.Duration("retry-max-delay", 5*time.Minute, "max delay between two retries of a network attachment")
+	statusInterval := flag.Duration("status-interval", 5*time.Second, "min interval between two writes of a pod's podagent.kaloom.com/networks-status annotation and podagent.kaloom.com/networks-ready condition")
+	podSelector := flag.String("pod-selector", "", "label selector of the pods managed by the podagent (e.g. podagent.kaloom.com/managed=true), empty for all pods")
+	namespaces := flag.String("namespaces", "", "comma-separated list of the namespaces of the pods managed by the podagent, empty for all namespaces")
+	excludeNamespaces := flag.String("exclude-namespaces", "", "comma-separated list of the namespaces whose pods aren't managed by the podagent")
+	kubeletURL := flag.String("kubelet-url", "", "url of the local kubelet (e.g. https://127.0.0.1:10250 or http://127.0.0.1:10255 for its read-only endpoint) whose /pods endpoint is polled instead of watching the pods on the apiserver, empty to watch the apiserver")
+	kubeletPollPeriod := flag.Duration("kubelet-poll-period", 5*time.Second, "period of the polling of the kubelet's pods")
+	kubeletTokenFile := flag.String("kubelet-token-file", "", "file of the bearer token authenticating to the kubelet (e.g. /var/run/secrets/kubernetes.io/serviceaccount/token)")
+	kubeletCAFile := flag.String("kubelet-ca-file", "", "CA of the kubelet's serving certificate, the system's CAs are used if empty")
+	kubeletInsecure := flag.Bool("kubelet-insecure-skip-tls-verify", false, "don't verify the kubelet's serving certificate (e.g. a self-signed one)")
+	healthAddress := flag.String("health-address", "", "address (e.g. :9440) on which /healthz and /readyz are served, empty to disable it")
+	debugAddress := flag.String("debug-address", "", "address (e.g. 127.0.0.1:9441) on which /debug/flags/v, setting the logs verbosity at runtime, is served, empty to disable it. It's unauthenticated, keep it on localhost")
+	metricsAddress := flag.String("metrics-address", "", "address (e.g. :9442) on which the Prometheus metrics are served on /metrics, empty to disable it")
+	logFormat := flag.String("log-format", textLogFormat, "format of the logs, either text or json")
+	configFile := flag.String("config", "", "podagent's configuration file (YAML or JSON), the flags set on the command line override its settings, the reloadable ones are applied on SIGHUP")
+	printSetting := flag.String("print-setting", "", "display the value of the given flag once the config file and the command line are applied and exit (e.g. direct-delegate)")
 	showVersion := flag.Bool("version", false, "display build details and exist")
 	flag.Parse()
 
@@ -53,24 +95,73 @@ func main() {
 		return
 	}
 
+	// the flags set on the command line override the configuration file
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var podagentCfg *podagentConfig
+	if *configFile != "" {
+		var err error
+		if podagentCfg, err = loadConfig(*configFile); err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+		if err := applyConfig(flag.CommandLine, podagentCfg, explicit); err != nil {
+			fmt.Printf("Invalid config file %s: %v\n", *configFile, err)
+			return
+		}
+	}
+
+	if *printSetting != "" {
+		f := flag.Lookup(*printSetting)
+		if f == nil {
+			fmt.Printf("Unknown -print-setting flag %s\n", *printSetting)
+			return
+		}
+		fmt.Println(f.Value.String())
+		return
+	}
+
+	if err := setupLogging(*logFormat); err != nil {
+		fmt.Printf("Invalid -log-format: %v\n", err)
+		return
+	}
+
 	if *nodeName == "" {
 		fmt.Printf("The node name as registered by kubelet over kube-apiserver must be provided via the -node command-line argument\n")
 		return
 	}
-	glog.Infof("node %s", *nodeName)
-	glog.Infof("cniBinPath %s", *cniBinPath)
+	klog.InfoS("Starting podagent", "node", *nodeName, "cniBinPath", *cniBinPath)
 
-	kubeClient, err := createClient(*kubeconfig)
+	cfg, err := createConfig(*kubeconfig)
+	if err != nil {
+		fmt.Printf("Failed to create kubernetes client config: %v\n", err)
+		return
+	}
+	kubeClient, err := createClient(cfg)
 	if err != nil {
 		fmt.Printf("Failed to create kubernetes client: %v\n", err)
 		return
 	}
+	dynamicClient, err := createDynamicClient(cfg)
+	if err != nil {
+		fmt.Printf("Failed to create kubernetes dynamic client: %v\n", err)
+		return
+	}
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
+	// in-flight cni-plugin invocations get killed on shutdown
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		klog.InfoS("Received signal, shutting down", "signal", sig)
+		cancelFunc()
+	}()
 
 	var endPoint *string
 	var containerType controller.ContainerType
-	glog.Infof("containerType: %s", *containerTypeArg)
 	if *containerTypeArg == "crio" {
 		endPoint = crioEndpoint
 		containerType = controller.Crio
@@ -78,13 +169,82 @@ func main() {
 		endPoint = dockerEndpoint
 		containerType = controller.Docker
 	}
-	glog.Infof("containerType (resolved): %s %v %s", *containerTypeArg, containerType, *endPoint)
-	controller, err := controller.NewController(kubeClient, *endPoint, *cniBinPath, *cniConfPath, *cniVendorName, containerType)
+	klog.InfoS("Resolved container type", "containerType", *containerTypeArg, "resolved", containerType, "endpoint", *endPoint)
+	ctrl, err := controller.NewController(controller.Options{
+		KubeClient:     kubeClient,
+		DynamicClient:  dynamicClient,
+		ContainerType:  containerType,
+		Endpoint:       *endPoint,
+		CNIBinPath:     *cniBinPath,
+		CNIConfPath:    *cniConfPath,
+		CNIVendor:      *cniVendorName,
+		CNITimeout:     *cniTimeout,
+		UseNsenter:     *useNsenter,
+		ResyncPeriod:   *resyncPeriod,
+		CheckPeriod:    *checkPeriod,
+		DirectDelegate: *directDelegate,
+		StatusInterval: *statusInterval,
+		ConfigDir:      *storeDir,
+		RetryDelay:     *retryInitialDelay,
+		MaxRetryDelay:  *retryMaxDelay,
+
+		PodLabelSelector:   *podSelector,
+		Namespaces:         splitList(*namespaces),
+		ExcludedNamespaces: splitList(*excludeNamespaces),
+		Kubelet: controller.KubeletOptions{
+			URL:                *kubeletURL,
+			PollPeriod:         *kubeletPollPeriod,
+			TokenFile:          *kubeletTokenFile,
+			CAFile:             *kubeletCAFile,
+			InsecureSkipVerify: *kubeletInsecure,
+		},
+	})
 	if err != nil {
 		fmt.Printf("Failed to create a controller: %v\n", err)
 		return
 	}
 
+	if *healthAddress != "" {
+		go serveHealth(*healthAddress, ctrl.Ready)
+	}
+	if *debugAddress != "" {
+		go serveDebug(*debugAddress)
+	}
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress, ctrl.MetricsHandler())
+	}
+
+	// the reloadable settings of the configuration file are applied on
+	// SIGHUP, an invalid file is ignored
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			if podagentCfg == nil {
+				klog.InfoS("Received SIGHUP without a config file, ignoring it")
+				continue
+			}
+			next, err := loadConfig(*configFile)
+			if err != nil {
+				klog.ErrorS(err, "Failed to reload the config file, keeping the current settings")
+				continue
+			}
+			reloaded, err := reloadConfig(flag.CommandLine, podagentCfg, next, explicit)
+			if err != nil {
+				klog.ErrorS(err, "Failed to reload the config file, keeping the current settings")
+				continue
+			}
+			podagentCfg = next
+			if reloaded {
+				ctrl.Reload(controller.ReloadableOptions{
+					StatusInterval: *statusInterval,
+					RetryDelay:     *retryInitialDelay,
+					MaxRetryDelay:  *retryMaxDelay,
+				})
+			}
+		}
+	}()
+
 	showBuildDetails()
-	controller.Run(ctx, *nodeName)
+	ctrl.Run(ctx, *nodeName)
 }
@@ -24,17 +24,32 @@ while :; do
     sleep 10
 done
 
+if [ -e /opt/kaloom/etc/podagent.conf ]; then
+    source /opt/kaloom/etc/podagent.conf
+fi
+
+# the podagent's configuration file, its settings are overridden by the
+# flags in PODAGENT_EXTRA_ARGS
+PODAGENT_CONFIG=${PODAGENT_CONFIG:-/opt/kaloom/etc/podagent.yaml}
+if [ -f "$PODAGENT_CONFIG" ]; then
+    config_args="-config $PODAGENT_CONFIG"
+fi
+
+# let the podagent resolve -direct-delegate off its config file and flags
+direct_delegate=$(/opt/kaloom/bin/podagent -print-setting direct-delegate $config_args $PODAGENT_EXTRA_ARGS)
+if [ "$direct_delegate" != "true" ] && [ "$direct_delegate" != "false" ]; then
+    echo "$direct_delegate"
+    exit 1
+fi
+
 cnitype=$(jq -r .type < $cni_cfg_file)
-if [ "$cnitype" != "kactus" ]; then
+if [ "$cnitype" != "kactus" ] && [ "$direct_delegate" != "true" ]; then
     echo "system is configured with an unsupported $cnitype cni-plugin"
     echo "currently only kactus know how to work with dynamic network attachment"
+    echo "unless the podagent invokes the networks' cni-plugins directly (i.e. -direct-delegate)"
     exit 1
 fi
 
-if [ -e /opt/kaloom/etc/podagent.conf ]; then
-    source /opt/kaloom/etc/podagent.conf
-fi
-
 if [ $running_as_pod -eq 1 ]; then
     # create /etc/cni/net.d inside the container and copy the host cni
     # config file as is stripping from it kubeconfig element to use for
@@ -52,4 +67,4 @@ if [ -f "$PODAGENT_KUBECONFIG" ]; then
     kubeconfig_args="-kubeconfig $PODAGENT_KUBECONFIG"
 fi
 
-/opt/kaloom/bin/podagent -node $PODAGENT_HOSTNAME $kubeconfig_args $PODAGENT_EXTRA_ARGS
+exec /opt/kaloom/bin/podagent -node $PODAGENT_HOSTNAME $kubeconfig_args $config_args $PODAGENT_EXTRA_ARGS